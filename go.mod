@@ -12,6 +12,7 @@ require (
 	github.com/pgaskin/koboutils/v2 v2.1.1
 	github.com/shermp/UNCaGED v0.7.1
 	github.com/unrolled/render v1.0.3
+	golang.org/x/text v0.13.0
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	gopkg.in/yaml.v2 v2.3.0 // indirect
 )
@@ -0,0 +1,133 @@
+// Copyright 2019-2020 Sherman Perry
+
+// This file is part of Kobo UNCaGED.
+
+// Kobo UNCaGED is free software: you can redistribute it and/or modify
+// it under the terms of the Affero GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Kobo UNCaGED is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with Kobo UNCaGED.  If not, see <https://www.gnu.org/licenses/>.
+
+package device
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/google/uuid"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// validateLibColumns checks the collection and read status columns of a library profile.
+// Collections can be made from tags, series and custom columns. The read status column must
+// be a custom yes/no column.
+func validateLibColumns(lo KuLibOptions) error {
+	for _, col := range lo.CollectionColumns {
+		if col != "tags" && col != "series" && !strings.HasPrefix(col, "#") {
+			return fmt.Errorf("'%s' can't be used for collections, use tags, series or a custom column", col)
+		}
+	}
+	if lo.ReadStatusColumn != "" && !strings.HasPrefix(lo.ReadStatusColumn, "#") {
+		return fmt.Errorf("read status column '%s' must be a custom column", lo.ReadStatusColumn)
+	}
+	return nil
+}
+
+// collectionNames returns the values of the columns cols for md, which are the names of the
+// collections the book is added to
+func collectionNames(md *uc.CalibreBookMeta, cols []string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	add := func(vals ...string) {
+		for _, v := range vals {
+			if v = strings.TrimSpace(v); v != "" && !seen[v] {
+				seen[v] = true
+				names = append(names, v)
+			}
+		}
+	}
+	for _, col := range cols {
+		switch col {
+		case "tags":
+			add(md.Tags...)
+		case "series":
+			if md.Series != nil {
+				add(*md.Series)
+			}
+		default:
+			cc, ok := md.UserMetadata[col]
+			if !ok {
+				continue
+			}
+			// Text columns hold a string, or a list of strings if they allow several values
+			switch v := cc.Value.(type) {
+			case string:
+				add(v)
+			case []interface{}:
+				for _, item := range v {
+					if s, ok := item.(string); ok {
+						add(s)
+					}
+				}
+			}
+		}
+	}
+	return names
+}
+
+// nickelShelfSQL returns the queries creating the Nickel collection name, or restoring it if it
+// was deleted. Nickel stores booleans as 'true' and 'false' strings.
+func nickelShelfSQL(dialect goqu.DialectWrapper, name string, now time.Time) ([]string, error) {
+	modified := now.UTC().Format(nickelTimeFormat)
+	exists := dialect.From("Shelf").Select(goqu.L("1")).Where(goqu.Ex{"InternalName": name})
+	create, _, err := dialect.Insert("Shelf").
+		Cols("CreationDate", "Id", "InternalName", "LastModified", "Name", "_IsDeleted", "_IsVisible", "_IsSynced").
+		FromQuery(dialect.Select(goqu.V(modified), goqu.V(uuid.New().String()), goqu.V(name), goqu.V(modified), goqu.V(name),
+			goqu.V("false"), goqu.V("true"), goqu.V("false")).Where(goqu.L("NOT EXISTS ?", exists))).
+		ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	restore, _, err := dialect.Update("Shelf").
+		Set(goqu.Record{"_IsDeleted": "false", "_IsVisible": "true", "LastModified": modified}).
+		Where(goqu.Ex{"InternalName": name, "_IsDeleted": "true"}).
+		ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	return []string{create, restore}, nil
+}
+
+// nickelShelfContentSQL returns the query adding the book cid to the Nickel collection name
+func nickelShelfContentSQL(dialect goqu.DialectWrapper, cid, name string, now time.Time) (string, error) {
+	modified := now.UTC().Format(nickelTimeFormat)
+	sqlStr, _, err := dialect.Insert("ShelfContent").
+		Rows(goqu.Record{"ShelfName": name, "ContentId": cid, "DateModified": modified, "_IsDeleted": "false", "_IsSynced": "false"}).
+		OnConflict(goqu.DoUpdate("ShelfName, ContentId", goqu.Record{"DateModified": modified, "_IsDeleted": "false"})).
+		ToSQL()
+	return sqlStr, err
+}
+
+// nickelReadStatusSQL returns the query marking cid as finished if col is set for md, or an empty
+// string if it isn't. Books that aren't marked in Calibre are left alone, so a book finished on
+// the Kobo isn't reset.
+func nickelReadStatusSQL(dialect goqu.DialectWrapper, cid string, md *uc.CalibreBookMeta, col string) (string, error) {
+	cc, ok := md.UserMetadata[col]
+	if read, isBool := cc.Value.(bool); !ok || !isBool || !read {
+		return "", nil
+	}
+	sqlStr, _, err := dialect.Update("content").
+		Set(goqu.Record{"ReadStatus": 2}).
+		Where(goqu.Ex{"ContentID": cid, "ContentType": 6}).
+		ToSQL()
+	return sqlStr, err
+}
@@ -0,0 +1,353 @@
+// Copyright 2019-2020 Sherman Perry
+
+// This file is part of Kobo UNCaGED.
+
+// Kobo UNCaGED is free software: you can redistribute it and/or modify
+// it under the terms of the Affero GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Kobo UNCaGED is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with Kobo UNCaGED.  If not, see <https://www.gnu.org/licenses/>.
+
+package device
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/kulog"
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// kuLegacyConfigFile is the config file used by older versions of KU
+const kuLegacyConfigFile = ".adds/kobo-uncaged/config/ku.toml"
+
+// kuConfigVersion is the version of the config format. Increase it, and add a migration to
+// configMigrations, whenever an option is renamed, or a default changes.
+const kuConfigVersion = 1
+
+// configMigrations[v] upgrades a config from version v to version v+1. It describes any
+// change that affects the options in use.
+var configMigrations = []func(cfg map[string]interface{}) []string{
+	migrateConfigV0,
+}
+
+// migrateConfigV0 upgrades configs written before the config was versioned. Missing options
+// got their default when the config was read, except preferKepub, which was only enabled by
+// default for new installs, and directConnIndex, which was only reset if there were no
+// direct connections.
+func migrateConfigV0(cfg map[string]interface{}) (changes []string) {
+	if _, exists := cfg["preferKepub"]; !exists {
+		cfg["preferKepub"] = false
+		changes = append(changes, "preferKepub wasn't set, so kepub is not preferred")
+	}
+	if _, exists := cfg["directConnIndex"]; !exists {
+		cfg["directConnIndex"] = -1
+		if dc, ok := cfg["directConn"].([]interface{}); ok && len(dc) > 0 {
+			cfg["directConnIndex"] = 0
+		}
+	}
+	return changes
+}
+
+// legacyConfigKeys are the options of ku.toml that are still used, by their names in
+// kuconfig.json, and an example of their type. ku.toml keys are matched ignoring case.
+var legacyConfigKeys = map[string]interface{}{
+	"preferSDCard":              false,
+	"preferKepub":               false,
+	"enableDebug":               false,
+	"thumbnail.generateLevel":   "",
+	"thumbnail.resizeAlgorithm": "",
+	"thumbnail.jpegQuality":     int64(0),
+}
+
+// legacyConfig converts a ku.toml config to an unversioned JSON config
+func legacyConfig(data []byte) ([]byte, []string, error) {
+	toml, err := util.ParseTOML(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ku.toml: %w", err)
+	}
+	cfg := map[string]interface{}{"version": 0}
+	notes := []string{"options were imported from ku.toml"}
+	for key, val := range toml {
+		name := ""
+		for k := range legacyConfigKeys {
+			if strings.EqualFold(k, key) {
+				name = k
+			}
+		}
+		switch {
+		case strings.EqualFold(key, "passwordList"):
+			notes = append(notes, "passwords in ku.toml were not imported, you will be asked for them when connecting")
+			continue
+		case name == "":
+			notes = append(notes, fmt.Sprintf("'%s' in ku.toml is no longer used", key))
+			continue
+		case reflect.TypeOf(val) != reflect.TypeOf(legacyConfigKeys[name]):
+			return nil, nil, fmt.Errorf("ku.toml: '%s' should be a %T, not a %T", key, legacyConfigKeys[name], val)
+		}
+		if i := strings.IndexByte(name, '.'); i >= 0 {
+			table, ok := cfg[name[:i]].(map[string]interface{})
+			if !ok {
+				table = make(map[string]interface{})
+				cfg[name[:i]] = table
+			}
+			table[name[i+1:]] = val
+		} else {
+			cfg[name] = val
+		}
+	}
+	sort.Strings(notes[1:])
+	data, err = json.Marshal(cfg)
+	return data, notes, err
+}
+
+// isLegacyConfig reports whether data looks like ku.toml rather than kuconfig.json
+func isLegacyConfig(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && data[0] != '{'
+}
+
+// kuConfigCorruptSuffix is added to the name of a config file that couldn't be read
+const kuConfigCorruptSuffix = ".corrupt"
+
+// maxConfigSize limits the size of an imported config
+const maxConfigSize = 1 << 20
+
+// defaultUserOptions returns the options used if there is no config file
+func defaultUserOptions() *KuOptions {
+	opts := &KuOptions{
+		Version:         kuConfigVersion,
+		PreferKepub:     true,
+		ReserveSpaceMB:  defaultReserveSpaceMB,
+		SanitizeProfile: defaultSanitizeProfile,
+		MetadataBackend: mdBackendJSON,
+		DirectConnIndex: -1,
+		DirectConn:      make([]uc.CalInstance, 0),
+	}
+	opts.Thumbnail.Validate()
+	opts.Thumbnail.SetRezFilter()
+	return opts
+}
+
+// jsonOffsetLine returns the line number of a byte offset in data
+func jsonOffsetLine(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// decodeUserOptions decodes a config, using the default for any option it doesn't set. If strict is
+// set, options KU doesn't know about are an error. Errors say where in the config the problem is.
+func decodeUserOptions(data []byte, strict bool) (*KuOptions, error) {
+	opts := defaultUserOptions()
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	err := dec.Decode(opts)
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		return opts, nil
+	case errors.As(err, &syntaxErr):
+		return nil, fmt.Errorf("line %d: %v", jsonOffsetLine(data, syntaxErr.Offset), err)
+	case errors.As(err, &typeErr):
+		return nil, fmt.Errorf("line %d: '%s' should be a %s, not a %s",
+			jsonOffsetLine(data, typeErr.Offset), typeErr.Field, typeErr.Type, typeErr.Value)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return nil, fmt.Errorf("the config ends unexpectedly")
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json doesn't have an error type for unknown fields
+		return nil, fmt.Errorf("unknown option %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	}
+	return nil, err
+}
+
+// parseUserOptions reads a kuconfig.json or ku.toml config, and upgrades it to the current
+// version. It also returns a description of anything that changed during the upgrade.
+func parseUserOptions(data []byte, strict bool) (*KuOptions, []string, error) {
+	var notes []string
+	if isLegacyConfig(data) {
+		var err error
+		if data, notes, err = legacyConfig(data); err != nil {
+			return nil, nil, err
+		}
+	}
+	opts, err := decodeUserOptions(data, strict)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Configs without a version were written before the config was versioned
+	var cfg map[string]interface{}
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return nil, nil, err
+	}
+	vers, _ := cfg["version"].(float64)
+	switch {
+	case int(vers) > kuConfigVersion && strict:
+		return nil, nil, fmt.Errorf("the config is from a newer version of KU (config version %d)", int(vers))
+	case int(vers) > kuConfigVersion:
+		notes = append(notes, "the config is from a newer version of KU, options this version doesn't know about were ignored")
+	case int(vers) < kuConfigVersion:
+		for v := int(vers); v < kuConfigVersion; v++ {
+			notes = append(notes, configMigrations[v](cfg)...)
+		}
+		cfg["version"] = kuConfigVersion
+		if data, err = json.Marshal(cfg); err != nil {
+			return nil, nil, err
+		}
+		if opts, err = decodeUserOptions(data, false); err != nil {
+			return nil, nil, err
+		}
+	}
+	opts.Version = kuConfigVersion
+	return opts, notes, nil
+}
+
+// normalizeUserOptions replaces any invalid options with their defaults, and describes each
+// option it corrected
+func normalizeUserOptions(opts *KuOptions) (fixed []string) {
+	fixed = opts.Thumbnail.Validate()
+	opts.Thumbnail.SetRezFilter()
+	if opts.ReserveSpaceMB < 0 {
+		fixed = append(fixed, fmt.Sprintf("reserved free space %d MB is negative, using 0", opts.ReserveSpaceMB))
+		opts.ReserveSpaceMB = 0
+	}
+	if !util.ValidSanitizeProfile(opts.SanitizeProfile) {
+		fixed = append(fixed, fmt.Sprintf("filename rules '%s' are invalid, using '%s'", opts.SanitizeProfile, defaultSanitizeProfile))
+		opts.SanitizeProfile = defaultSanitizeProfile
+	}
+	if !validMDbackend(opts.MetadataBackend) {
+		fixed = append(fixed, fmt.Sprintf("metadata storage '%s' is invalid, using '%s'", opts.MetadataBackend, mdBackendJSON))
+		opts.MetadataBackend = mdBackendJSON
+	}
+	if err := validateLpathTemplate(opts.LpathTemplate); err != nil {
+		fixed = append(fixed, fmt.Sprintf("save template '%s' is invalid (%v), using Calibre's", opts.LpathTemplate, err))
+		opts.LpathTemplate = ""
+	}
+	if err := validateLibOptions(opts.LibOptions); err != nil {
+		fixed = append(fixed, fmt.Sprintf("library profiles are invalid (%v), and were removed", err))
+		opts.LibOptions = nil
+	}
+	if opts.DirectConn == nil {
+		opts.DirectConn = make([]uc.CalInstance, 0)
+	}
+	if opts.DirectConnIndex < -1 || opts.DirectConnIndex >= len(opts.DirectConn) {
+		fixed = append(fixed, fmt.Sprintf("selected direct connection %d doesn't exist, using auto discover", opts.DirectConnIndex+1))
+		opts.DirectConnIndex = -1
+	}
+	return fixed
+}
+
+// validateUserOptions checks every option, returning an error that can be shown to the user
+// for the first that is invalid
+func validateUserOptions(opts *KuOptions) error {
+	switch opts.Thumbnail.GenerateLevel {
+	case generateAll, generatePartial, generateNone:
+	default:
+		return fmt.Errorf("Invalid thumbnail level '%s'", opts.Thumbnail.GenerateLevel)
+	}
+	switch opts.Thumbnail.ResizeAlgorithm {
+	case resizeBL, resizeBC, resizeLC2, resizeLC3:
+	default:
+		return fmt.Errorf("Invalid thumbnail resize algorithm '%s'", opts.Thumbnail.ResizeAlgorithm)
+	}
+	if opts.Thumbnail.JpegQuality < 1 || opts.Thumbnail.JpegQuality > 100 {
+		return fmt.Errorf("Thumbnail JPEG quality must be between 1 and 100")
+	}
+	if opts.ReserveSpaceMB < 0 {
+		return fmt.Errorf("Reserved free space can't be negative")
+	}
+	if err := validateLpathTemplate(opts.LpathTemplate); err != nil {
+		return fmt.Errorf("Invalid save template: %v", err)
+	}
+	if !util.ValidSanitizeProfile(opts.SanitizeProfile) {
+		return fmt.Errorf("Invalid filename rules")
+	}
+	if !validMDbackend(opts.MetadataBackend) {
+		return fmt.Errorf("Invalid metadata storage")
+	}
+	for from, to := range opts.SeriesAliases {
+		if strings.TrimSpace(from) == "" || strings.TrimSpace(to) == "" {
+			return fmt.Errorf("Invalid series alias")
+		}
+	}
+	if err := validateLibOptions(opts.LibOptions); err != nil {
+		return fmt.Errorf("Invalid library profile: %v", err)
+	}
+	for i, dc := range opts.DirectConn {
+		if strings.TrimSpace(dc.Host) == "" || dc.TCPPort < 1 || dc.TCPPort > 65535 {
+			return fmt.Errorf("Direct connection %d ('%s') needs a host and a port between 1 and 65535", i+1, dc.Name)
+		}
+	}
+	if opts.DirectConnIndex < -1 || opts.DirectConnIndex >= len(opts.DirectConn) {
+		return fmt.Errorf("Selected direct connection %d doesn't exist", opts.DirectConnIndex+1)
+	}
+	return nil
+}
+
+// getUserOptions reads the config file, or imports ku.toml if there isn't one. A config file
+// that can't be read is renamed, so it can be recovered over USB, and the default options
+// are used instead. Anything that was changed when reading the config is shown on the
+// config page.
+func (k *Kobo) getUserOptions() error {
+	fn := path.Join(k.DBRootDir, kuConfigFile)
+	opts := defaultUserOptions()
+	var notes []string
+	data, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		// ku.toml is only imported once, as kuconfig.json is saved after KU starts
+		data, err = ioutil.ReadFile(path.Join(k.DBRootDir, kuLegacyConfigFile))
+		if err == nil {
+			if opts, notes, err = parseUserOptions(data, false); err != nil {
+				kulog.Warnf("getUserOptions: ignoring ku.toml: %v", err)
+				opts = defaultUserOptions()
+			}
+		} else if !os.IsNotExist(err) {
+			kulog.Warnf("getUserOptions: failed to read ku.toml: %v", err)
+		}
+		data, err = nil, nil
+	}
+	if err != nil {
+		return fmt.Errorf("getUserOptions: %w", err)
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		if opts, notes, err = parseUserOptions(data, false); err != nil {
+			backup := fn + kuConfigCorruptSuffix
+			if rerr := os.Rename(fn, backup); rerr != nil {
+				return fmt.Errorf("getUserOptions: failed to back up unreadable config (%v): %w", err, rerr)
+			}
+			kulog.Warnf("getUserOptions: config file could not be read, saved as '%s': %v", backup, err)
+			k.configWarning = fmt.Sprintf("Your config could not be read (%v). It was saved as %s, and the default options are being used.", err, path.Base(backup))
+			opts = defaultUserOptions()
+		}
+	}
+	notes = append(notes, normalizeUserOptions(opts)...)
+	for _, n := range notes {
+		kulog.Warnf("getUserOptions: %s", n)
+	}
+	if len(notes) > 0 && k.configWarning == "" {
+		k.configWarning = fmt.Sprintf("Your config was updated: %s. Press Start to save it.", strings.Join(notes, "; "))
+	}
+	k.KuConfig = opts
+	return nil
+}
@@ -1,14 +1,18 @@
 package device
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"image"
 	"image/jpeg"
-	"log"
+	"net"
 	"net/http"
 	"os"
 	"path"
@@ -16,6 +20,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/bamiaux/rez"
@@ -27,8 +32,8 @@ import (
 	"github.com/google/uuid"
 	"github.com/kapmahc/epub"
 	"github.com/pgaskin/koboutils/v2/kobo"
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/kulog"
 	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
-	"github.com/shermp/UNCaGED/calibre"
 	"github.com/shermp/UNCaGED/uc"
 )
 
@@ -39,11 +44,20 @@ const calibreDIfile = "driveinfo.calibre"
 const kuUpdatedMDfile = "metadata_update.kobouc"
 const kuUpdatedSQL = ".adds/kobo-uncaged/updated-md.sql"
 const kuBookReplaceSQL = ".adds/kobo-uncaged/replace-book.sql"
-const kuPassCache = ".adds/kobo-uncaged/.ku_pwcache.json"
+const kuPassCache = ".adds/kobo-uncaged/.ku_pwcache"
+const kuLegacyPassCache = ".adds/kobo-uncaged/.ku_pwcache.json"
 const kuConfigFile = ".adds/kobo-uncaged/config/kuconfig.json"
+const kuDeleteQueue = ".adds/kobo-uncaged/delete-queue.json"
+const recentLogLines = 200
 const ndbInterface = "com.github.shermp.nickeldbus"
 const viewChangedName = ndbInterface + ".ndbViewChanged"
 
+// defaultReserveSpaceMB is the default amount of space kept free for Nickel's database and covers
+const defaultReserveSpaceMB = 50
+
+// ErrInsufficientSpace is returned when saving a book would use space reserved for Nickel
+var ErrInsufficientSpace = errors.New("not enough free space")
+
 const onboardPrefix cidPrefix = "file:///mnt/onboard/"
 const sdPrefix cidPrefix = "file:///mnt/sd/"
 
@@ -54,22 +68,68 @@ func isBrowserViewSignal(vs *dbus.Signal) (bool, error) {
 	return vs.Body[0].(string) == "N3BrowserView", nil
 }
 
+// browserURL checks that bindAddress is safe to listen on, and returns the address
+// the browser should open. Listening on anything other than a loopback address
+// requires an explicit opt-in, as it exposes the web UI to the network.
+func browserURL(bindAddress string, allowRemote bool) (string, error) {
+	host, port, err := net.SplitHostPort(bindAddress)
+	if err != nil {
+		return "", fmt.Errorf("browserURL: invalid bind address '%s': %w", bindAddress, err)
+	}
+	ip := net.ParseIP(host)
+	isLoopback := host == "localhost" || (ip != nil && ip.IsLoopback())
+	if !isLoopback && !allowRemote {
+		return "", fmt.Errorf("browserURL: refusing to listen on non-loopback address '%s' without -allowremote", bindAddress)
+	}
+	// The Kobo browser always runs locally, so use the loopback address unless
+	// we are bound to a specific non-loopback address
+	if host == "" || isLoopback || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port) + "/", nil
+}
+
+// newAuthToken generates a random token used to authenticate web UI requests for this session
+func newAuthToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
 // New creates a Kobo object, ready for use
-func New(dbRootDir, sdRootDir string, bindAddress string, disableNDB bool, vers string) (*Kobo, error) {
+func New(dbRootDir, sdRootDir string, bindAddress string, allowRemote, disableNDB bool, vers string) (*Kobo, error) {
 	var err error
 	k := &Kobo{}
+	uiURL, err := browserURL(bindAddress, allowRemote)
+	if err != nil {
+		return nil, fmt.Errorf("New: %w", err)
+	}
+	if k.authToken, err = newAuthToken(); err != nil {
+		return nil, fmt.Errorf("New: failed to generate web UI token: %w", err)
+	}
+	// The log can be read over USB and from the diagnostics page, so it must never hold the token
+	kulog.Redact(k.authToken)
+	uiURL += "?token=" + k.authToken
+	if allowRemote {
+		// Only shown to whoever started KU, for opening the web UI from another machine
+		fmt.Fprintf(os.Stderr, "Web UI available at %s\n", uiURL)
+	}
+	// Keep the most recent log lines around for the diagnostics page
+	k.recentLog = util.NewLogRing(recentLogLines)
+	kulog.AddOutput(k.recentLog)
 	k.Wg = &sync.WaitGroup{}
 	k.DBRootDir = dbRootDir
+	k.SDRootDir = sdRootDir
 	k.BKRootDir = dbRootDir
 	k.ContentIDprefix = onboardPrefix
 	if err = k.getUserOptions(); err != nil {
 		return nil, fmt.Errorf("New: failed to read config file: %w", err)
 	}
-	if len(k.KuConfig.DirectConn) == 0 {
-		k.KuConfig.DirectConnIndex = -1
-		k.KuConfig.DirectConn = make([]calibre.ConnectionInfo, 0)
-	}
-	if sdRootDir != "" && k.KuConfig.PreferSDCard {
+	kulog.SetDebug(k.KuConfig.EnableDebug)
+	k.effOpts = k.KuConfig.withLibOptions(k.KuConfig.LastLibrary)
+	if sdRootDir != "" && k.effOpts.PreferSDCard {
 		k.UseSDCard = true
 		k.BKRootDir = sdRootDir
 		k.ContentIDprefix = sdPrefix
@@ -78,7 +138,18 @@ func New(dbRootDir, sdRootDir string, bindAddress string, disableNDB bool, vers
 	k.UpdatedMetadata = make(map[string]struct{}, 0)
 	k.SeriesIDMap = make(map[string]string, 0)
 	k.PassCache = make(calPassCache)
-	log.Println("Getting Kobo Info")
+	k.deleteQueue = make(map[string]deleteMark)
+	k.bookInfo = make(map[string]bookInfo)
+	k.journal.Completed = make(map[string]journalEntry)
+	k.lpathAliases = make(map[string]string)
+	k.requestedLpaths = make(map[string]string)
+	k.migrated = make(map[string]storageBook)
+	// Books marked for deletion in a previous session are still waiting to be deleted.
+	// Failing to read the queue isn't fatal, the user can mark the books again.
+	if _, err = util.ReadJSON(filepath.Join(k.DBRootDir, kuDeleteQueue), &k.deleteQueue); err != nil {
+		kulog.Warnf("%v", err)
+	}
+	kulog.Infof("Getting Kobo Info")
 	if err = k.getKoboInfo(); err != nil {
 		return nil, fmt.Errorf("New: failed to get kobo info: %w", err)
 	}
@@ -87,6 +158,7 @@ func New(dbRootDir, sdRootDir string, bindAddress string, disableNDB bool, vers
 	if k.UseSDCard {
 		k.webInfo.StorageType = "External SD Storage"
 	}
+	k.webInfo.HasSDCard = sdRootDir != ""
 	k.BrowserOpen = true
 	k.useNDB = !disableNDB
 	if k.useNDB {
@@ -95,16 +167,15 @@ func New(dbRootDir, sdRootDir string, bindAddress string, disableNDB bool, vers
 		}
 		k.ndbObj = k.ndbConn.Object(ndbInterface, "/nickeldbus")
 	}
-	k.doneChan = make(chan bool)
-	k.MsgChan = make(chan WebMsg)
+	k.events = newEventBus(webEventHistory, webEventBuffer)
 	k.startChan = make(chan webConfig)
 	k.AuthChan = make(chan *calPassword)
 	k.calInstChan = make(chan uc.CalInstance)
 	k.exitChan = make(chan bool)
 	k.initWeb()
 	go func() {
-		if err = http.ListenAndServe(bindAddress, k.mux); err != nil {
-			log.Println(err)
+		if err = http.ListenAndServe(bindAddress, k.requireToken(k.mux)); err != nil {
+			kulog.Err(err)
 		}
 	}()
 	if k.useNDB {
@@ -124,7 +195,7 @@ func New(dbRootDir, sdRootDir string, bindAddress string, disableNDB bool, vers
 		if strings.HasSuffix(currView, "PowerView") {
 			return nil, fmt.Errorf("New: currently in sleep mode. Aborting")
 		}
-		res := k.ndbObj.Call(ndbInterface+".bwmOpenBrowser", 0, true, "http://127.0.0.1:8181/")
+		res := k.ndbObj.Call(ndbInterface+".bwmOpenBrowser", 0, true, uiURL)
 		if res.Err != nil {
 			return nil, fmt.Errorf("New: failed to open web browser")
 		}
@@ -165,8 +236,19 @@ func New(dbRootDir, sdRootDir string, bindAddress string, disableNDB bool, vers
 		if opt.err != nil {
 			return nil, fmt.Errorf("New: failed to get start config: %w", err)
 		}
+		prevBackend := k.KuConfig.MetadataBackend
+		opt.Opts.Thumbnail.SetRezFilter()
+		k.cfgMux.Lock()
 		k.KuConfig = &opt.Opts
-		k.KuConfig.Thumbnail.SetRezFilter()
+		k.effOpts = k.KuConfig.withLibOptions(k.KuConfig.LastLibrary)
+		k.cfgMux.Unlock()
+		// The web UI may have already loaded the metadata with the previous backend
+		if k.KuConfig.MetadataBackend != prevBackend {
+			if err = k.closeMDstore(); err != nil {
+				return nil, fmt.Errorf("New: %w", err)
+			}
+		}
+		kulog.SetDebug(k.KuConfig.EnableDebug)
 		if err = k.SaveUserOptions(); err != nil {
 			return nil, fmt.Errorf("New: failed to save updated config options to file: %w", err)
 		}
@@ -175,20 +257,25 @@ func New(dbRootDir, sdRootDir string, bindAddress string, disableNDB bool, vers
 		time.Sleep(500 * time.Millisecond)
 		return nil, nil
 	}
+	k.Session = newSessionLog(func(se SessionError) { k.WebSend(WebMsg{Error: &se}) })
 	k.WebSend(WebMsg{ShowMessage: "Gathering information about your Kobo", Progress: -1})
-	log.Println("Getting Device Info")
+	kulog.Infof("Getting Device Info")
 	if err = k.loadDeviceInfo(); err != nil {
 		return nil, fmt.Errorf("New: failed to load device info: %w", err)
 	}
-	log.Println("Reading Metadata")
-	if err = k.readMDfile(); err != nil {
+	kulog.Infof("Reading Metadata")
+	if err = k.loadMetadata(); err != nil {
 		return nil, fmt.Errorf("New: failed to read metadata file: %w", err)
 	}
-	log.Println("Reading password cache")
+	kulog.Infof("Reading password cache")
 	// Failing to retrieve the password cache isn't fatal. The user will be asked
 	// for their password if required.
 	if err = k.readPassCache(); err != nil {
-		log.Print(err)
+		kulog.Err(err)
+	}
+	// Delete any books marked before connecting, so Calibre sees an up to date book list
+	if err = k.ProcessDeleteQueue(); err != nil {
+		kulog.Err(err)
 	}
 	select {
 	case <-k.exitChan:
@@ -198,26 +285,76 @@ func New(dbRootDir, sdRootDir string, bindAddress string, disableNDB bool, vers
 	}
 }
 
+// passCacheKey derives the password cache encryption key from the device serial number.
+// This won't stop a determined attacker with access to the device, but it does mean the
+// passwords aren't sitting in plain sight for anyone who plugs the Kobo into a computer.
+func (k *Kobo) passCacheKey() []byte {
+	key := sha256.Sum256([]byte("Kobo-UNCaGED password cache:" + k.serial))
+	return key[:]
+}
+
 func (k *Kobo) readPassCache() error {
-	if _, err := util.ReadJSON(filepath.Join(k.DBRootDir, kuPassCache), &k.PassCache); err != nil {
+	if k.KuConfig.DisablePassCache {
+		// Make sure there are no passwords left over from before the cache was disabled
+		return k.removePassCache()
+	}
+	emptyOrNotExist, err := util.ReadEncryptedJSON(filepath.Join(k.DBRootDir, kuPassCache), k.passCacheKey(), &k.PassCache)
+	if err != nil {
 		return fmt.Errorf("readPassCache: failed to read password cache: %w", err)
 	}
+	if emptyOrNotExist {
+		// Older versions of KU stored passwords in plain text. Read them so
+		// they can be migrated to the encrypted cache.
+		legacyEmpty, err := util.ReadJSON(filepath.Join(k.DBRootDir, kuLegacyPassCache), &k.PassCache)
+		if err != nil {
+			return fmt.Errorf("readPassCache: failed to read legacy password cache: %w", err)
+		}
+		if !legacyEmpty {
+			kulog.Infof("Migrating plain text password cache")
+			if err = k.WritePassCache(); err != nil {
+				return fmt.Errorf("readPassCache: failed to migrate legacy password cache: %w", err)
+			}
+		}
+	}
 	for calUUID := range k.PassCache {
+		if k.PassCache[calUUID] == nil {
+			delete(k.PassCache, calUUID)
+			continue
+		}
 		k.PassCache[calUUID].Attempts = 0
+		kulog.Redact(k.PassCache[calUUID].Password)
 	}
 	return nil
 }
 
-// WritePassCache writes the password cache to a file
+// removePassCache deletes both the encrypted, and legacy plain text password caches
+func (k *Kobo) removePassCache() error {
+	for _, fn := range []string{kuPassCache, kuLegacyPassCache} {
+		if err := os.Remove(filepath.Join(k.DBRootDir, fn)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removePassCache: failed to remove password cache: %w", err)
+		}
+	}
+	return nil
+}
+
+// WritePassCache writes the encrypted password cache to a file. If the user has chosen
+// not to save passwords, any existing cache is removed instead.
 func (k *Kobo) WritePassCache() error {
+	if k.KuConfig.DisablePassCache {
+		return k.removePassCache()
+	}
 	// Delete any blank passwords in the cache before saving
 	for calUUID := range k.PassCache {
-		if k.PassCache[calUUID].Password == "" {
+		if k.PassCache[calUUID] == nil || k.PassCache[calUUID].Password == "" {
 			delete(k.PassCache, calUUID)
 		}
 	}
-	if err := util.WriteJSON(filepath.Join(k.DBRootDir, kuPassCache), k.PassCache); err != nil {
-		return fmt.Errorf("readPassCache: failed to write password cache: %w", err)
+	if err := util.WriteEncryptedJSON(filepath.Join(k.DBRootDir, kuPassCache), k.passCacheKey(), k.PassCache); err != nil {
+		return fmt.Errorf("WritePassCache: failed to write password cache: %w", err)
+	}
+	// The plain text cache is no longer required once the encrypted cache has been written
+	if err := os.Remove(filepath.Join(k.DBRootDir, kuLegacyPassCache)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("WritePassCache: failed to remove legacy password cache: %w", err)
 	}
 	return nil
 }
@@ -230,8 +367,10 @@ func (k *Kobo) GetPassword(calUUID, calLibName string) string {
 	}
 	k.PassCache[calUUID].Attempts++
 	if k.PassCache[calUUID].Attempts > 1 || k.PassCache[calUUID].Password == "" {
+		k.dialogMux.Lock()
+		k.pendingAuth = k.PassCache[calUUID]
+		k.dialogMux.Unlock()
 		k.WebSend(WebMsg{GetPassword: true})
-		k.AuthChan <- k.PassCache[calUUID]
 		k.PassCache[calUUID] = <-k.AuthChan
 	}
 	return k.PassCache[calUUID].Password
@@ -243,38 +382,27 @@ func (k *Kobo) GetCalibreInstance(calInstances []uc.CalInstance) uc.CalInstance
 	if len(calInstances) == 1 {
 		return calInstances[0]
 	}
+	k.dialogMux.Lock()
 	k.calInstances = calInstances
+	k.pendingInstance = true
+	k.dialogMux.Unlock()
 	k.WebSend(WebMsg{GetCalInstance: true})
 	return <-k.calInstChan
 }
 
-func (k *Kobo) getUserOptions() error {
-	// Note, we return opts, regardless of whether we successfully read the options file.
-	// Our code can handle the default struct gracefully
-	opts := &KuOptions{}
-	notExists, err := util.ReadJSON(path.Join(k.DBRootDir, kuConfigFile), opts)
-	if err != nil {
-		return err
-	} else if notExists {
-		opts.PreferKepub = true
-		// Note that opts.Thumbnail.Validate() sets thumbnail defaults, so no need
-		// to set them here.
-	}
-	opts.Thumbnail.Validate()
-	opts.Thumbnail.SetRezFilter()
-	k.KuConfig = opts
-	return nil
-}
-
 func (k *Kobo) SaveUserOptions() error {
-	return util.WriteJSON(path.Join(k.DBRootDir, kuConfigFile), k.KuConfig)
+	k.cfgMux.Lock()
+	k.KuConfig.Version = kuConfigVersion
+	k.cfgMux.Unlock()
+	cfg := k.config()
+	return util.WriteJSON(path.Join(k.DBRootDir, kuConfigFile), &cfg)
 }
 
 // UpdateIfExists updates onboard metadata if it exists in the Nickel database
 func (k *Kobo) UpdateIfExists(cID string, len int) error {
 	var err error
-	if _, exists := k.MetadataMap[cID]; exists {
-		if k.MetadataMap[cID].Size == len {
+	if md, exists := k.GetMetadata(cID); exists {
+		if md.Size == len {
 			return nil
 		}
 		if k.replSQLWriter == nil {
@@ -291,7 +419,7 @@ func (k *Kobo) UpdateIfExists(cID string, len int) error {
 }
 
 func (k *Kobo) getKoboInfo() error {
-	_, vers, id, err := kobo.ParseKoboVersion(k.DBRootDir)
+	serial, vers, id, err := kobo.ParseKoboVersion(k.DBRootDir)
 	if err != nil {
 		return fmt.Errorf("New: %w", err)
 	}
@@ -301,18 +429,20 @@ func (k *Kobo) getKoboInfo() error {
 		return fmt.Errorf("New: unknown device")
 	}
 	k.fw = firmwareVersion(vers)
+	k.serial = serial
 	return nil
 }
 
 // GetDeviceOptions gets some device options that UNCaGED requires
 func (k *Kobo) GetDeviceOptions() (ext []string, model string, thumbSz image.Point) {
-	if k.KuConfig.PreferKepub {
+	opts := k.opts()
+	if opts.PreferKepub {
 		ext = []string{"kepub", "epub", "mobi", "pdf", "cbz", "cbr", "txt", "html", "rtf"}
 	} else {
 		ext = []string{"epub", "kepub", "mobi", "pdf", "cbz", "cbr", "txt", "html", "rtf"}
 	}
 	model = k.Device.Family()
-	switch k.KuConfig.Thumbnail.GenerateLevel {
+	switch opts.Thumbnail.GenerateLevel {
 	case generateAll:
 		thumbSz = k.Device.CoverSize(kobo.CoverTypeFull)
 	case generatePartial:
@@ -401,37 +531,81 @@ func (k *Kobo) readEpubMeta(contentID string, md *uc.CalibreBookMeta) error {
 	return nil
 }
 
-// readMDfile loads cached metadata from the "metadata.calibre" JSON file
-// and unmarshals (eventially) to a map of KoboMetadata structs, converting
-// "lpath" to Kobo's "ContentID", and using that as the map keys
-func (k *Kobo) readMDfile() error {
-	log.Println("Reading metadata.calibre")
-
-	var koboMD []uc.CalibreBookMeta
-	emptyOrNotExist, err := util.ReadJSON(filepath.Join(k.BKRootDir, calibreMDfile), &koboMD)
-	if emptyOrNotExist {
-		// ignore
-	} else if err != nil {
-		return fmt.Errorf("readMDfile: error reading metadata.calibre JSON: %w", err)
+// loadMetadata reads the metadata cache, unless it has already been loaded. The web UI
+// may need the metadata before the user has started the Calibre connection.
+func (k *Kobo) loadMetadata() error {
+	k.mdLoadMux.Lock()
+	defer k.mdLoadMux.Unlock()
+	k.mdMux.RLock()
+	loaded := k.md != nil
+	k.mdMux.RUnlock()
+	if loaded {
+		return nil
 	}
+	return k.readMDfile()
+}
 
-	// Make the metadatamap here instead of the constructer so we can pre-allocate
-	// the memory with the right size.
-	k.MetadataMap = make(map[string]uc.CalibreBookMeta, len(koboMD))
-	// make a temporary map for easy searching later
-	tmpMap := make(map[string]int, len(koboMD))
-	for n, md := range koboMD {
-		contentID := util.LpathToContentID(util.LpathKepubConvert(md.Lpath), string(k.ContentIDprefix))
-		tmpMap[contentID] = n
+// readMDfile loads cached metadata into the metadata store, using the configured backend.
+// The "metadata.calibre" JSON file is imported, unless the store is already up to date
+// with it. The store is then updated with any books in the Nickel database not in the
+// cache, using the ContentID as the key.
+func (k *Kobo) readMDfile() error {
+	kulog.Infof("Reading metadata.calibre")
+	mdFile := filepath.Join(k.BKRootDir, calibreMDfile)
+	var store mdStore = newMemStore()
+	if k.KuConfig.MetadataBackend == mdBackendSQLite {
+		ss, err := openSQLiteStore(filepath.Join(k.DBRootDir, kuMetadataDB), string(k.ContentIDprefix))
+		if err != nil {
+			return fmt.Errorf("readMDfile: %w", err)
+		}
+		store = ss
+	}
+	// Note, the web UI may be reading the metadata, so the new store is only swapped in
+	// once it is up to date.
+	ok := false
+	defer func() {
+		if !ok {
+			store.close()
+		}
+	}()
+	storeStamp, err := store.stamp()
+	if err != nil {
+		return fmt.Errorf("readMDfile: %w", err)
 	}
-	log.Println("Gathering metadata")
+	// metadata.calibre only needs importing if it has been changed by something other than
+	// KU (such as Calibre over USB), or the store is new
+	if stamp := mdFileStamp(mdFile); stamp == "" || stamp != storeStamp {
+		err = store.replaceAll(func(add func(string, mdEntry) error) error {
+			return readMDentries(mdFile, func(e mdEntry) error {
+				return add(util.LpathToContentID(util.LpathKepubConvert(e.md.Lpath), string(k.ContentIDprefix)), e)
+			})
+		})
+		if err != nil {
+			return fmt.Errorf("readMDfile: error reading metadata.calibre JSON: %w", err)
+		}
+		if err = store.setStamp(stamp); err != nil {
+			return fmt.Errorf("readMDfile: %w", err)
+		}
+	}
+	prevUnmanaged, err := store.unmanaged()
+	if err != nil {
+		return fmt.Errorf("readMDfile: %w", err)
+	}
+	unmanagedByCID := make(map[string]mdEntry, len(prevUnmanaged))
+	for _, e := range prevUnmanaged {
+		unmanagedByCID[util.LpathToContentID(util.LpathKepubConvert(e.md.Lpath), string(k.ContentIDprefix))] = e
+	}
+	// The ContentIDs of every book in the Nickel database
+	dbCIDs := make(map[string]struct{})
+	// metadata.calibre only needs writing if it doesn't match the database
+	dirty := false
+	kulog.Infof("Gathering metadata")
 	var nickelDB *sql.DB
 	dsn := "file:" + filepath.Join(k.DBRootDir, koboDBpath) + "?_timeout=2000&_journal=WAL&mode=ro&_mutex=full&_sync=NORMAL"
 	if nickelDB, err = sql.Open("sqlite3", dsn); err != nil {
 		return fmt.Errorf("openNickelDB: sql open failed: %w", err)
 	}
 	defer nickelDB.Close()
-	//spew.Dump(k.MetadataMap)
 	// Now that we have our map, we need to check for any books in the DB not in our
 	// metadata cache, or books that are in our cache but not in the DB
 	var (
@@ -465,10 +639,22 @@ func (k *Kobo) readMDfile() error {
 		if err != nil {
 			return fmt.Errorf("readMDfile: row decoding error: %w", err)
 		}
-		if _, exists := tmpMap[dbCID]; !exists {
-			log.Printf("Book not in cache: %s\n", dbCID)
+		dbCIDs[dbCID] = struct{}{}
+		e, exists, err := store.get(dbCID)
+		if err != nil {
+			return fmt.Errorf("readMDfile: %w", err)
+		}
+		adopted := false
+		if !exists {
+			// The book may have been imported by Nickel since it was last seen
+			e, adopted = unmanagedByCID[dbCID]
+			exists = adopted
+		}
+		if !exists {
+			kulog.Infof("Book not in cache: %s", dbCID)
+			dirty = true
 			bkMD := uc.CalibreBookMeta{}
-			bkMD.Lpath = util.ContentIDtoLpath(dbCID, string(onboardPrefix))
+			bkMD.Lpath = util.ContentIDtoLpath(dbCID, string(k.ContentIDprefix))
 			uuidV4, _ := uuid.NewRandom()
 			bkMD.UUID = uuidV4.String()
 			bkMD.Comments, bkMD.Publisher, bkMD.Series = dbDesc, dbPublisher, dbSeries
@@ -500,21 +686,77 @@ func (k *Kobo) readMDfile() error {
 				bkMD.LastModified = &lastMod
 			}
 			//spew.Dump(bkMD)
-			k.MetadataMap[dbCID] = bkMD
+			if err = store.put(dbCID, mdEntry{md: bkMD}); err != nil {
+				return fmt.Errorf("readMDfile: %w", err)
+			}
 		} else {
 			// Make sure we are using the filesize as exists in the DB
-			koboMD[tmpMap[dbCID]].Size = dbFileSize
-			k.MetadataMap[dbCID] = koboMD[tmpMap[dbCID]]
+			if e.md.Size != dbFileSize || adopted {
+				e.md.Size = dbFileSize
+				dirty = true
+				if err = store.put(dbCID, e); err != nil {
+					return fmt.Errorf("readMDfile: %w", err)
+				}
+			}
 		}
 	}
 	if err = bkRows.Err(); err != nil {
 		return fmt.Errorf("readMDfile: bkRows error: %w", err)
 	}
-	// Finally, store a snapshot of books in database before we make any additions/deletions
-	k.BooksInDB = make(map[string]struct{}, len(k.MetadataMap))
-	for cid := range k.MetadataMap {
-		k.BooksInDB[cid] = struct{}{}
+	// Entries for books KU doesn't manage (not yet imported by Nickel, or not sideloaded)
+	// are written back unchanged, as long as the book is still there
+	var unmanaged []mdEntry
+	var stale []string
+	keepUnmanaged := func(e mdEntry) {
+		if _, err := os.Stat(filepath.Join(k.BKRootDir, e.md.Lpath)); err == nil {
+			unmanaged = append(unmanaged, e)
+		} else {
+			dirty = true
+		}
+	}
+	err = store.each(func(cid string, e mdEntry) error {
+		if _, inDB := dbCIDs[cid]; !inDB {
+			stale = append(stale, cid)
+			keepUnmanaged(e)
+			dirty = true
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("readMDfile: %w", err)
+	}
+	for _, cid := range stale {
+		if err = store.remove(cid); err != nil {
+			return fmt.Errorf("readMDfile: %w", err)
+		}
+	}
+	for cid, e := range unmanagedByCID {
+		if _, inDB := dbCIDs[cid]; !inDB {
+			keepUnmanaged(e)
+		}
 	}
+	if err = store.setUnmanaged(unmanaged); err != nil {
+		return fmt.Errorf("readMDfile: %w", err)
+	}
+	bi := k.readBookInfo(dbCIDs)
+	// Books received in an interrupted session may not have made it to metadata.calibre
+	recovered, err := k.recoverJournal(store, bi)
+	if err != nil {
+		return fmt.Errorf("readMDfile: %w", err)
+	}
+	k.mdMux.Lock()
+	for _, cid := range recovered {
+		k.UpdatedMetadata[cid] = struct{}{}
+		dbCIDs[cid] = struct{}{}
+		dirty = true
+	}
+	k.md = store
+	k.bookInfo = bi
+	k.mdDirty = dirty
+	k.mdMux.Unlock()
+	ok = true
+	// Finally, store a snapshot of books in database before we make any additions/deletions
+	k.BooksInDB = dbCIDs
 	// Hopefully, our metadata is now up to date. Update the cache on disk
 	if err = k.WriteMDfile(); err != nil {
 		return fmt.Errorf("readMDfile: error writing metadata to disk: %w", err)
@@ -522,19 +764,239 @@ func (k *Kobo) readMDfile() error {
 	return nil
 }
 
-// WriteMDfile writes metadata to file
+// WriteMDfile writes metadata to file, if it has changed since it was last written. Any
+// pending scheduled write is cancelled.
 func (k *Kobo) WriteMDfile() error {
-	var n int
-	var err error
-	metadata := make([]uc.CalibreBookMeta, len(k.MetadataMap))
-	for _, md := range k.MetadataMap {
-		metadata[n] = md
-		n++
+	k.cancelMDwrite()
+	k.mdWriteMux.Lock()
+	defer k.mdWriteMux.Unlock()
+	k.mdMux.RLock()
+	defer k.mdMux.RUnlock()
+	if k.md != nil && k.mdDirty {
+		mdFile := filepath.Join(k.BKRootDir, calibreMDfile)
+		unmanaged, err := k.md.unmanaged()
+		if err != nil {
+			return fmt.Errorf("WriteMDfile: %w", err)
+		}
+		err = writeMDentries(mdFile, func(write func(mdEntry) error) error {
+			if err := k.md.each(func(_ string, e mdEntry) error { return write(e) }); err != nil {
+				return err
+			}
+			for _, e := range unmanaged {
+				// KU may have since received this book from Calibre
+				cid := util.LpathToContentID(util.LpathKepubConvert(e.md.Lpath), string(k.ContentIDprefix))
+				if _, managed := k.getMDentry(cid); managed {
+					continue
+				}
+				if err := write(e); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("WriteMDfile: %w", err)
+		}
+		// The store is now in sync with metadata.calibre
+		if err = k.md.setStamp(mdFileStamp(mdFile)); err != nil {
+			return fmt.Errorf("WriteMDfile: %w", err)
+		}
+		if err = util.WriteJSON(filepath.Join(k.DBRootDir, kuBookInfo), k.bookInfo); err != nil {
+			return fmt.Errorf("WriteMDfile: error writing book info: %w", err)
+		}
+		// Only WriteMDfile touches mdDirty without mdMux locked for writing, and writes
+		// are serialised by mdWriteMux
+		k.mdDirty = false
+	}
+	// Everything in the journal is now in metadata.calibre
+	if err := k.clearJournal(); err != nil {
+		return fmt.Errorf("WriteMDfile: %w", err)
+	}
+	return nil
+}
+
+// SetMetadata adds or replaces the metadata for a book. Any fields from other drivers
+// are kept.
+func (k *Kobo) SetMetadata(cid string, md uc.CalibreBookMeta) error {
+	k.mdMux.Lock()
+	defer k.mdMux.Unlock()
+	e, _ := k.getMDentry(cid)
+	e.md = md
+	if err := k.md.put(cid, e); err != nil {
+		return fmt.Errorf("SetMetadata: %w", err)
+	}
+	k.mdDirty = true
+	return nil
+}
+
+// FreeSpace returns the amount of space available on the storage books are saved to
+func (k *Kobo) FreeSpace() (uint64, error) {
+	return freeSpaceAt(k.BKRootDir)
+}
+
+// freeSpaceAt returns the space available on the filesystem containing dir
+func freeSpaceAt(dir string) (uint64, error) {
+	// Note, this method of getting available disk space is Linux specific...
+	// Don't try to run this code on Windows. It will probably fall over
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, fmt.Errorf("FreeSpace: %w", err)
+	}
+	return fs.Bavail * uint64(fs.Bsize), nil
+}
+
+// ReservedSpace returns the number of bytes that should be kept free for Nickel
+func (k *Kobo) ReservedSpace() uint64 {
+	if k.KuConfig.ReserveSpaceMB <= 0 {
+		return 0
+	}
+	return uint64(k.KuConfig.ReserveSpaceMB) * 1024 * 1024
+}
+
+// CheckSpaceFor returns ErrInsufficientSpace if saving a book of size bytes would
+// use space reserved for Nickel. Note, a book being replaced is only removed once the
+// new copy has been received, so its space cannot be counted as free.
+func (k *Kobo) CheckSpaceFor(size int64) error {
+	free, err := k.FreeSpace()
+	if err != nil {
+		return fmt.Errorf("CheckSpaceFor: unable to check free space: %w", err)
+	}
+	reserved := k.ReservedSpace()
+	if free < reserved || free-reserved < uint64(size) {
+		return fmt.Errorf("CheckSpaceFor: %w: book needs %d KB, %d KB free with %d MB reserved",
+			ErrInsufficientSpace, size/1024, free/1024, k.KuConfig.ReserveSpaceMB)
+	}
+	return nil
+}
+
+// HasMetadata reports whether the metadata store contains the book
+func (k *Kobo) HasMetadata(cid string) bool {
+	k.mdMux.RLock()
+	defer k.mdMux.RUnlock()
+	_, exists := k.getMDentry(cid)
+	return exists
+}
+
+// MarkMetadataUpdated records that the metadata of a book changed, so it is written to
+// the Kobo database when KU exits
+func (k *Kobo) MarkMetadataUpdated(cid string) {
+	k.mdMux.Lock()
+	defer k.mdMux.Unlock()
+	k.UpdatedMetadata[cid] = struct{}{}
+}
+
+// RemoveBook deletes a book from the device, along with any parent directories
+// left empty, and removes the book from the metadata store
+func (k *Kobo) RemoveBook(cid string) error {
+	// Start with basic book deletion. A more fancy implementation can come later
+	// (eg: removing cover image remnants etc)
+	bkPath := util.ContentIDtoBkPath(k.BKRootDir, cid, string(k.ContentIDprefix))
+	kulog.Debugf("CID: %s, bkPath: %s", cid, bkPath)
+	if err := os.Remove(bkPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("RemoveBook: error deleting file: %w", err)
+	}
+	removeEmptyDirs(filepath.Dir(bkPath), k.BKRootDir)
+	k.mdMux.Lock()
+	defer k.mdMux.Unlock()
+	// Now we remove the book from the metadata store
+	if err := k.md.remove(cid); err != nil {
+		return fmt.Errorf("RemoveBook: %w", err)
+	}
+	// As well as the updated metadata list, if it was added to the list this session
+	delete(k.UpdatedMetadata, cid)
+	delete(k.deleteQueue, cid)
+	delete(k.bookInfo, cid)
+	k.mdDirty = true
+	return nil
+}
+
+// removeEmptyDirs removes dir, and any parent directories below root, if they are empty
+func removeEmptyDirs(dir, root string) {
+	dirPath := filepath.Clean(dir)
+	for dirPath != filepath.Clean(root) && strings.HasPrefix(dirPath, filepath.Clean(root)) {
+		// Note, os.Remove only removes empty directories, so it should be safe to call
+		if err := os.Remove(dirPath); err != nil {
+			// We don't consider failure to remove parent directories an error, so
+			// long as the book file itself was deleted.
+			break
+		}
+		// Walk 'up' the path
+		dirPath = filepath.Clean(filepath.Join(dirPath, "../"))
+	}
+}
+
+// MarkForDeletion adds or removes a book from the deletion queue. The queue is saved
+// to disk, so books marked before KU exits will be deleted next time.
+func (k *Kobo) MarkForDeletion(cid string, marked bool) error {
+	k.mdMux.Lock()
+	defer k.mdMux.Unlock()
+	e, exists := k.getMDentry(cid)
+	if !exists {
+		return fmt.Errorf("MarkForDeletion: book not found")
+	}
+	if marked {
+		k.deleteQueue[cid] = deleteMark{Title: e.md.Title, UUID: e.md.UUID}
+	} else {
+		delete(k.deleteQueue, cid)
+	}
+	return k.saveDeleteQueue()
+}
+
+// saveDeleteQueue writes the deletion queue to disk. The caller must hold mdMux
+func (k *Kobo) saveDeleteQueue() error {
+	if err := util.WriteJSON(filepath.Join(k.DBRootDir, kuDeleteQueue), k.deleteQueue); err != nil {
+		return fmt.Errorf("saveDeleteQueue: %w", err)
+	}
+	return nil
+}
+
+// ProcessDeleteQueue deletes the books the user has marked for deletion in the web UI.
+// Books on the storage not currently in use are left in the queue for later.
+func (k *Kobo) ProcessDeleteQueue() error {
+	k.mdMux.Lock()
+	type queued struct{ cid, title string }
+	queue := make([]queued, 0, len(k.deleteQueue))
+	for cid, mark := range k.deleteQueue {
+		if !strings.HasPrefix(cid, string(k.ContentIDprefix)) {
+			continue
+		}
+		// Drop books that have already been removed, or replaced by a different book
+		if e, exists := k.getMDentry(cid); !exists || (mark.UUID != "" && e.md.UUID != mark.UUID) {
+			kulog.Infof("Book no longer on device, removing from delete queue: %s", cid)
+			delete(k.deleteQueue, cid)
+			continue
+		}
+		queue = append(queue, queued{cid: cid, title: mark.Title})
 	}
-	if err = util.WriteJSON(filepath.Join(k.BKRootDir, calibreMDfile), metadata); err != nil {
-		err = fmt.Errorf("WriteMDfile: %w", err)
+	err := k.saveDeleteQueue()
+	k.mdMux.Unlock()
+	if err != nil {
+		return fmt.Errorf("ProcessDeleteQueue: %w", err)
 	}
-	return err
+	if len(queue) == 0 {
+		return nil
+	}
+	for i, q := range queue {
+		// Note, the queue may be processed after Calibre has disconnected, so the browser may have been closed
+		if k.BrowserOpen {
+			k.WebSend(WebMsg{ShowMessage: fmt.Sprintf("Deleting: %s", q.title), Progress: (i * 100) / len(queue)})
+		}
+		if err := k.RemoveBook(q.cid); err != nil {
+			k.Session.AddError(q.title, err)
+			return fmt.Errorf("ProcessDeleteQueue: %w", err)
+		}
+		k.Session.BookDeleted()
+		k.mdMux.Lock()
+		err := k.saveDeleteQueue()
+		k.mdMux.Unlock()
+		if err != nil {
+			return fmt.Errorf("ProcessDeleteQueue: %w", err)
+		}
+	}
+	if err := k.WriteMDfile(); err != nil {
+		return fmt.Errorf("ProcessDeleteQueue: error writing metadata file: %w", err)
+	}
+	return nil
 }
 
 func (k *Kobo) loadDeviceInfo() error {
@@ -567,17 +1029,24 @@ func (k *Kobo) SaveCoverImage(contentID string, size image.Point, imgB64 string)
 
 	img, _, err := image.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgB64)))
 	if err != nil {
-		log.Println(err)
+		kulog.Err(err)
 		return
 	}
 	sz := img.Bounds().Size()
 
 	imgID := kobo.ContentIDToImageID(contentID)
 	//fmt.Printf("Image ID is: %s\n", imgID)
-	jpegOpts := jpeg.Options{Quality: k.KuConfig.Thumbnail.JpegQuality}
+	thumb := k.opts().Thumbnail
+	jpegOpts := jpeg.Options{Quality: thumb.JpegQuality}
 
+	generated := false
+	defer func() {
+		if generated {
+			k.Session.CoverGenerated()
+		}
+	}()
 	var coverEndings []kobo.CoverType
-	switch k.KuConfig.Thumbnail.GenerateLevel {
+	switch thumb.GenerateLevel {
 	case generateAll:
 		coverEndings = []kobo.CoverType{kobo.CoverTypeFull, kobo.CoverTypeLibFull, kobo.CoverTypeLibGrid}
 	case generatePartial:
@@ -587,16 +1056,16 @@ func (k *Kobo) SaveCoverImage(contentID string, size image.Point, imgB64 string)
 		nsz := k.Device.CoverSized(cover, sz)
 		nfn := filepath.Join(k.BKRootDir, cover.GeneratePath(k.UseSDCard, imgID))
 		//fmt.Printf("Cover file path is: %s\n", nfn)
-		log.Printf("Resizing %s cover to %s (target %s) for %s\n", sz, nsz, k.Device.CoverSize(cover), cover)
+		kulog.Debugf("Resizing %s cover to %s (target %s) for %s", sz, nsz, k.Device.CoverSize(cover), cover)
 
 		var nimg image.Image
 		if !sz.Eq(nsz) {
 			nimg = image.NewYCbCr(image.Rect(0, 0, nsz.X, nsz.Y), img.(*image.YCbCr).SubsampleRatio)
-			rez.Convert(nimg, img, k.KuConfig.Thumbnail.rezFilter)
-			log.Printf(" -- Resized to %s\n", nimg.Bounds().Size())
+			rez.Convert(nimg, img, thumb.rezFilter)
+			kulog.Debugf(" -- Resized to %s", nimg.Bounds().Size())
 		} else {
 			nimg = img
-			log.Println(" -- Skipped resize: already correct size")
+			kulog.Debugf(" -- Skipped resize: already correct size")
 		}
 		// Optimization. No need to resize libGrid from the full cover size...
 		if cover == kobo.CoverTypeLibFull {
@@ -604,21 +1073,23 @@ func (k *Kobo) SaveCoverImage(contentID string, size image.Point, imgB64 string)
 		}
 
 		if err := os.MkdirAll(filepath.Dir(nfn), 0755); err != nil {
-			log.Println(err)
+			kulog.Err(err)
 			continue
 		}
 
 		lf, err := os.OpenFile(nfn, os.O_WRONLY|os.O_CREATE, 0644)
 		if err != nil {
-			log.Println(err)
+			kulog.Err(err)
 			continue
 		}
 
 		if err := jpeg.Encode(lf, nimg, &jpegOpts); err != nil {
-			log.Println(err)
+			kulog.Err(err)
 			lf.Close()
+			continue
 		}
 		lf.Close()
+		generated = true
 	}
 }
 
@@ -635,25 +1106,35 @@ func (k *Kobo) WriteUpdatedMetadataSQL() error {
 	}
 	defer updateSQL.close()
 	dialect := goqu.Dialect("sqlite3")
-	var desc, series, seriesNum, subtitle *string
+	// Note, the SeriesID stuff was implemented in FW 4.20.14601
+	hasSeriesID := kobo.VersionCompare(string(k.fw), "4.20.14601") >= 0
+	matcher := k.newSeriesMatcher()
+	_, libOpts := k.currentLibrary()
+	var desc, series, seriesID, seriesNum, subtitle *string
 	var seriesNumFloat *float64
+	now := time.Now()
+	shelves := make(map[string]bool)
 	for cid := range k.UpdatedMetadata {
-		desc, series, seriesNum, seriesNumFloat, subtitle = nil, nil, nil, nil, nil
-		if k.MetadataMap[cid].Comments != nil && *k.MetadataMap[cid].Comments != "" {
-			desc = k.MetadataMap[cid].Comments
+		desc, series, seriesID, seriesNum, seriesNumFloat, subtitle = nil, nil, nil, nil, nil, nil
+		md, exists := k.GetMetadata(cid)
+		if !exists {
+			continue
+		}
+		if md.Comments != nil && *md.Comments != "" {
+			desc = md.Comments
 		}
-		if k.MetadataMap[cid].Series != nil && *k.MetadataMap[cid].Series != "" {
-			// TODO: Fuzzy series matching to deal with 'The' prefixes and 'Series' postfixes?
-			series = k.MetadataMap[cid].Series
+		if md.Series != nil && *md.Series != "" {
+			// Use the name and ID of a matching store series, so Nickel groups them together
+			name, id := matcher.match(*md.Series)
+			series, seriesID = &name, &id
 		}
-		if k.MetadataMap[cid].SeriesIndex != nil && *k.MetadataMap[cid].SeriesIndex != 0.0 {
-			sn := strconv.FormatFloat(*k.MetadataMap[cid].SeriesIndex, 'f', -1, 64)
+		if md.SeriesIndex != nil && *md.SeriesIndex != 0.0 {
+			sn := strconv.FormatFloat(*md.SeriesIndex, 'f', -1, 64)
 			seriesNum = &sn
-			seriesNumFloat = k.MetadataMap[cid].SeriesIndex
+			seriesNumFloat = md.SeriesIndex
 		}
-		if field, exists := k.KuConfig.LibOptions[k.LibInfo.LibraryUUID]; exists && field.SubtitleColumn != "" {
-			col := field.SubtitleColumn
-			md := k.MetadataMap[cid]
+		if libOpts.SubtitleColumn != "" {
+			col := libOpts.SubtitleColumn
 			st := ""
 			if col == "languages" {
 				st = md.LangString()
@@ -672,18 +1153,71 @@ func (k *Kobo) WriteUpdatedMetadataSQL() error {
 				subtitle = &st
 			}
 		}
-		ds := dialect.Update("content").Set(goqu.Record{
+		rec := goqu.Record{
 			"Description": desc, "Series": series, "SeriesNumber": seriesNum, "SeriesNumberFloat": seriesNumFloat, "Subtitle": subtitle,
-		}).Where(goqu.Ex{"ContentID": cid})
+		}
+		if hasSeriesID {
+			rec["SeriesID"] = seriesID
+		}
+		addNickelFields(rec, &md, k.KuConfig.NickelFields)
+		// User defined templates override everything else, including the subtitle column
+		for col, val := range mapNickelFields(&md, libOpts.FieldMap) {
+			rec[col] = val
+			switch {
+			case col == "Series" && hasSeriesID:
+				rec["SeriesID"] = nil
+				if val != nil {
+					_, id := matcher.match(*val)
+					rec["SeriesID"] = &id
+				}
+			case col == "SeriesNumber":
+				rec["SeriesNumberFloat"] = nil
+				if val != nil {
+					if f, err := strconv.ParseFloat(*val, 64); err == nil {
+						rec["SeriesNumberFloat"] = &f
+					}
+				}
+			}
+		}
+		ds := dialect.Update("content").Set(rec).Where(goqu.Ex{"ContentID": cid})
 		sqlStr, _, err := ds.ToSQL()
 		if err != nil {
 			return fmt.Errorf("WriteUpdatedMetadataSQL: failed ")
 		}
 		updateSQL.writeQuery(sqlStr)
+		if k.KuConfig.NickelFields.Rating {
+			if sqlStr, err = nickelRatingSQL(dialect, cid, &md, now); err != nil {
+				return fmt.Errorf("WriteUpdatedMetadataSQL: failed to build rating query: %w", err)
+			} else if sqlStr != "" {
+				updateSQL.writeQuery(sqlStr)
+			}
+		}
+		for _, name := range collectionNames(&md, libOpts.CollectionColumns) {
+			if !shelves[name] {
+				queries, err := nickelShelfSQL(dialect, name, now)
+				if err != nil {
+					return fmt.Errorf("WriteUpdatedMetadataSQL: failed to build collection query: %w", err)
+				}
+				for _, q := range queries {
+					updateSQL.writeQuery(q)
+				}
+				shelves[name] = true
+			}
+			if sqlStr, err = nickelShelfContentSQL(dialect, cid, name, now); err != nil {
+				return fmt.Errorf("WriteUpdatedMetadataSQL: failed to build collection query: %w", err)
+			}
+			updateSQL.writeQuery(sqlStr)
+		}
+		if libOpts.ReadStatusColumn != "" {
+			if sqlStr, err = nickelReadStatusSQL(dialect, cid, &md, libOpts.ReadStatusColumn); err != nil {
+				return fmt.Errorf("WriteUpdatedMetadataSQL: failed to build read status query: %w", err)
+			} else if sqlStr != "" {
+				updateSQL.writeQuery(sqlStr)
+			}
+		}
 	}
-	// Note, the SeriesID stuff was implemented in FW 4.20.14601
-	if kobo.VersionCompare(string(k.fw), "4.20.14601") >= 0 {
-		// Set the SeriesID column correctly
+	if hasSeriesID {
+		// Set the SeriesID column correctly for any other sideloaded books
 		// Note, UPDATE FROM is brand spanking new in SQLite 3.33.0 (2020-08-14). We're going to need the latest
 		// client for this one
 		updateSQL.writeQuery(
@@ -692,8 +1226,8 @@ FROM (
 	SELECT DISTINCT Series, SeriesID FROM content 
 	WHERE ContentType = 6 AND ContentID NOT LIKE 'file://%' AND (Series IS NOT NULL AND Series <> '') AND (SeriesID IS NOT NULL AND SeriesID <> '')
 ) AS c 
-WHERE content.Series = c.Series;`)
-		updateSQL.writeQuery(`UPDATE content SET SeriesID=Series WHERE ContentType = 6 AND (Series IS NOT NULL OR Series <> '') AND (SeriesID IS NULL OR SeriesID <> '');`)
+WHERE content.Series = c.Series AND content.ContentID LIKE 'file://%';`)
+		updateSQL.writeQuery(`UPDATE content SET SeriesID=Series WHERE ContentType = 6 AND ContentID LIKE 'file://%' AND (Series IS NOT NULL AND Series <> '') AND (SeriesID IS NULL OR SeriesID = '');`)
 	}
 	return nil
 }
@@ -701,13 +1235,30 @@ WHERE content.Series = c.Series;`)
 // Close the kobo object when we're finished with it
 func (k *Kobo) Close() {
 	k.Wg.Wait()
+	// Make sure any scheduled metadata write happens before exiting
+	if err := k.closeMDstore(); err != nil {
+		kulog.Err(err)
+	}
 	if k.replSQLWriter != nil {
 		k.replSQLWriter.close()
 	}
+	summary := k.Session.finish(k.FinishedMsg)
+	libInfo, _ := k.currentLibrary()
+	summary.LibraryUUID = libInfo.LibraryUUID
+	summary.LibraryName = libInfo.LibraryName
+	summary.DeviceModel = k.Device.String()
+	summary.Firmware = string(k.fw)
+	if err := appendSessionHistory(filepath.Join(k.DBRootDir, kuSessionHistory), summary); err != nil {
+		kulog.Err(err)
+	}
 	if k.useNDB && !k.BrowserOpen {
 		k.ndbObj.Call(ndbInterface+".mwcToast", 0, 3000, k.FinishedMsg)
 	} else {
-		k.WebSend(WebMsg{Finished: k.FinishedMsg})
+		// Give the browser a chance to receive the final message before we exit
+		id := k.publishWebMsg(WebMsg{Finished: k.FinishedMsg, Summary: &summary})
+		if !k.events.flush(id, finishedFlushTimeout) {
+			kulog.Warnf("Timed out waiting for the browser to receive the finished message")
+		}
 	}
 	if k.ndbConn != nil {
 		k.ndbConn.Close()
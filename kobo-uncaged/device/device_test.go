@@ -0,0 +1,639 @@
+package device
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+func TestBrowserURL(t *testing.T) {
+	tests := []struct {
+		bind        string
+		allowRemote bool
+		want        string
+		wantErr     bool
+	}{
+		{"127.0.0.1:8181", false, "http://127.0.0.1:8181/", false},
+		{"localhost:8080", false, "http://127.0.0.1:8080/", false},
+		{"[::1]:8181", false, "http://127.0.0.1:8181/", false},
+		{"0.0.0.0:8181", false, "", true},
+		{":8181", false, "", true},
+		{"192.168.1.10:8181", false, "", true},
+		{"0.0.0.0:8181", true, "http://127.0.0.1:8181/", false},
+		{"192.168.1.10:8181", true, "http://192.168.1.10:8181/", false},
+		{"no-port", true, "", true},
+	}
+	for _, tc := range tests {
+		got, err := browserURL(tc.bind, tc.allowRemote)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("browserURL(%q, %v) error = %v, wantErr %v", tc.bind, tc.allowRemote, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("browserURL(%q, %v) = %q, want %q", tc.bind, tc.allowRemote, got, tc.want)
+		}
+	}
+}
+
+func TestEventBus(t *testing.T) {
+	b := newEventBus(2, 1)
+	// Publishing with no subscribers must not block
+	b.publish("showMessage", "one")
+	b.publish("showMessage", "two")
+	last := b.publish("showMessage", "three")
+	b.publishSticky("auth", "")
+
+	sub, replay := b.subscribe(0)
+	if len(replay) != 3 || replay[2].name != "auth" {
+		t.Fatalf("unexpected replay: %v", replay)
+	}
+	var env struct {
+		Version int    `json:"version"`
+		Type    string `json:"type"`
+		Seq     uint64 `json:"seq"`
+		Payload string `json:"payload"`
+	}
+	if err := json.Unmarshal([]byte(replay[0].data), &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.Version != eventSchemaVersion || env.Type != "showMessage" || env.Seq != replay[0].id || env.Payload != "two" {
+		t.Errorf("unexpected event: %+v", env)
+	}
+	b.clearSticky("auth")
+	if _, replay = b.subscribe(last); len(replay) != 0 {
+		t.Errorf("expected nothing to replay, got %v", replay)
+	}
+
+	// sub has a buffer of one, so the second event disconnects it
+	b.publish("progress", "1")
+	id := b.publish("progress", "2")
+	<-sub.ch
+	if _, ok := <-sub.ch; ok {
+		t.Error("expected lagging subscriber to be disconnected")
+	}
+	sub, _ = b.subscribe(id)
+	id = b.publish("kuFinished", "done")
+	if b.flush(id, 100*time.Millisecond) {
+		t.Error("expected flush to time out before the event was delivered")
+	}
+	b.markDelivered(sub, (<-sub.ch).id)
+	if !b.flush(id, 100*time.Millisecond) {
+		t.Error("expected flush to succeed once the event was delivered")
+	}
+}
+
+func TestExpandLpathTemplate(t *testing.T) {
+	series, idx := "Dune", 2.0
+	md := uc.CalibreBookMeta{
+		Title:       "Dune Messiah",
+		Authors:     []string{"Frank Herbert"},
+		AuthorSort:  "Herbert, Frank",
+		Series:      &series,
+		SeriesIndex: &idx,
+	}
+	tests := []struct {
+		tmpl, want string
+		wantErr    bool
+	}{
+		{"{author_sort}/{title} - {authors}", "Herbert, Frank/Dune Messiah - Frank Herbert", false},
+		{"{series}/{series_index} {title}", "Dune/2 Dune Messiah", false},
+		{"{publisher}/{title}", "/Dune Messiah", false},
+		{"{title", "", true},
+		{"{nope}", "", true},
+		{"title}", "", true},
+	}
+	for _, tt := range tests {
+		got, err := expandLpathTemplate(tt.tmpl, &md)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("expandLpathTemplate(%q) error = %v, wantErr %v", tt.tmpl, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expandLpathTemplate(%q) = %q, want %q", tt.tmpl, got, tt.want)
+		}
+	}
+	if err := validateLpathTemplate("books/static"); err == nil {
+		t.Errorf("validateLpathTemplate accepted a template without fields")
+	}
+}
+
+func TestFieldMap(t *testing.T) {
+	series, idx := "Dune", 2.0
+	md := uc.CalibreBookMeta{
+		Title:        "Dune Messiah",
+		Series:       &series,
+		SeriesIndex:  &idx,
+		UserMetadata: map[string]uc.CalibreCustomColumn{"#genre": {Datatype: "text", Value: "Science Fiction"}},
+	}
+	fm, err := validateFieldMap(map[string]string{
+		"subtitle":    "{series} [{series_index}] - {#genre}",
+		"Publisher":   "{publisher:|Published by |}",
+		"Attribution": "{#missing:|by |}",
+		"title":       "{publisher}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subtitle := "Dune [2] - Science Fiction"
+	got := mapNickelFields(&md, fm)
+	want := map[string]*string{"Subtitle": &subtitle, "Publisher": nil, "Attribution": nil}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mapNickelFields() = %v, want %v", got, want)
+	}
+	for _, bad := range []map[string]string{{"ContentID": "{title}"}, {"Title": "{title:|a}"}, {"Title": "{nope}"}} {
+		if _, err := validateFieldMap(bad); err == nil {
+			t.Errorf("validateFieldMap(%v) accepted an invalid field map", bad)
+		}
+	}
+}
+
+func TestWithLibOptions(t *testing.T) {
+	yes, tmpl := true, "{title}"
+	opts := &KuOptions{
+		PreferKepub: false,
+		Thumbnail:   thumbnailOption{GenerateLevel: generateAll, ResizeAlgorithm: resizeBC, JpegQuality: 90},
+		LibOptions: map[string]KuLibOptions{
+			"lib": {PreferKepub: &yes, LpathTemplate: &tmpl, Thumbnail: &thumbnailOption{GenerateLevel: generateNone}},
+		},
+	}
+	eff := opts.withLibOptions("lib")
+	if !eff.PreferKepub || eff.PreferSDCard || eff.LpathTemplate != tmpl || eff.Thumbnail.GenerateLevel != generateNone {
+		t.Errorf("withLibOptions(lib) = %+v", eff)
+	}
+	if opts.PreferKepub || opts.Thumbnail.GenerateLevel != generateAll {
+		t.Errorf("withLibOptions changed the global options")
+	}
+	if eff = opts.withLibOptions("other"); eff.PreferKepub || eff.LpathTemplate != "" {
+		t.Errorf("withLibOptions(other) = %+v", eff)
+	}
+}
+
+func TestUserOptions(t *testing.T) {
+	opts, _, err := parseUserOptions([]byte(`{"version": 1, "reserveSpaceMB": 10}`), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.PreferKepub || opts.ReserveSpaceMB != 10 || opts.MetadataBackend != mdBackendJSON || opts.DirectConnIndex != -1 {
+		t.Errorf("parseUserOptions() = %+v", opts)
+	}
+	// Unversioned configs keep the defaults they were written with
+	opts, notes, err := parseUserOptions([]byte(`{"directConn": [{"host": "pc", "port": 9090}]}`), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.PreferKepub || opts.DirectConnIndex != 0 || opts.Version != kuConfigVersion || len(notes) != 1 {
+		t.Errorf("parseUserOptions(v0) = %+v, %q", opts, notes)
+	}
+	toml := "PreferSDCard = true\npasswordList = [\"secret\"]\n[thumbnail]\njpegQuality = 150\n"
+	if opts, notes, err = parseUserOptions([]byte(toml), false); err != nil {
+		t.Fatal(err)
+	}
+	if !opts.PreferSDCard || opts.PreferKepub || len(notes) != 3 {
+		t.Errorf("parseUserOptions(ku.toml) = %+v, %q", opts, notes)
+	}
+	if fixed := normalizeUserOptions(opts); opts.Thumbnail.JpegQuality != 90 || len(fixed) != 1 {
+		t.Errorf("normalizeUserOptions() = %q, quality %d", fixed, opts.Thumbnail.JpegQuality)
+	}
+	bad := []struct{ config, want string }{
+		{"{\n\"preferKepub\": true,\n}", "line 3"},
+		{"{\n\"reserveSpaceMB\": \"50\"}", "line 2: 'reserveSpaceMB' should be a int"},
+		{`{"prefer_kepub": true}`, `unknown option "prefer_kepub"`},
+		{`{"version": 99}`, "newer version"},
+		{"preferKepub = \"yes\"", "'preferKepub' should be a bool"},
+	}
+	for _, tt := range bad {
+		if _, _, err = parseUserOptions([]byte(tt.config), true); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseUserOptions(%q) error = %v, want %q", tt.config, err, tt.want)
+		}
+	}
+	opts = defaultUserOptions()
+	if err = validateUserOptions(opts); err != nil {
+		t.Errorf("default options are invalid: %v", err)
+	}
+	opts.DirectConn = append(opts.DirectConn, uc.CalInstance{Name: "pc", Host: "pc.local"})
+	if err = validateUserOptions(opts); err == nil {
+		t.Errorf("validateUserOptions accepted a direct connection without a port")
+	}
+
+	dir, err := ioutil.TempDir("", "ku-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, kuConfigFile)
+	if err = os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(fn, []byte(`{"preferKepub": fals`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	k := &Kobo{DBRootDir: dir}
+	if err = k.getUserOptions(); err != nil {
+		t.Fatal(err)
+	}
+	if !k.KuConfig.PreferKepub || k.configWarning == "" {
+		t.Errorf("corrupt config was not replaced with the defaults")
+	}
+	if _, err = os.Stat(fn + kuConfigCorruptSuffix); err != nil {
+		t.Errorf("corrupt config was not backed up: %v", err)
+	}
+}
+
+func TestLpathCollisions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ku-md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sqlStore, err := openSQLiteStore(filepath.Join(dir, "metadata.sqlite"), "file:///mnt/onboard/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlStore.close()
+	for _, store := range []mdStore{newMemStore(), sqlStore} {
+		store.put("file:///mnt/onboard/Author/book.epub", mdEntry{md: uc.CalibreBookMeta{Lpath: "Author/book.epub", UUID: "a"}})
+		store.put("file:///mnt/onboard/Author/A_B.epub", mdEntry{md: uc.CalibreBookMeta{Lpath: "Author/A_B.epub", UUID: "b"}})
+		opts := &KuOptions{SanitizeProfile: defaultSanitizeProfile}
+		k := &Kobo{
+			KuConfig:        opts,
+			effOpts:         opts,
+			BKRootDir:       dir,
+			ContentIDprefix: "file:///mnt/onboard/",
+			md:              store,
+			bookInfo: map[string]bookInfo{
+				"file:///mnt/onboard/Author/A_B.epub": {RequestedLpath: "Author/A:B.epub"},
+			},
+			lpathAliases:    make(map[string]string),
+			requestedLpaths: make(map[string]string),
+		}
+		checks := []struct{ lpath, want string }{
+			{"Author/book.epub", "Author/book.epub"},
+			{"Author/Book.epub", "Author/Book (1).epub"},
+			{"Author/A:B.epub", "Author/A_B.epub"},
+			{"Author/A?B.epub", "Author/A_B (1).epub"},
+		}
+		for _, c := range checks {
+			if got := k.CheckLpath(c.lpath); got != c.want {
+				t.Errorf("CheckLpath(%q) = %q, want %q", c.lpath, got, c.want)
+			}
+		}
+		// Files KU doesn't know about aren't overwritten either
+		if err = os.MkdirAll(filepath.Join(dir, "Other"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, "Other", "Sideloaded.epub"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		checks = []struct{ lpath, want string }{
+			{"Other/Sideloaded.epub", "Other/Sideloaded (1).epub"},
+			{"other/sideloaded.epub", "other/sideloaded (1).epub"},
+			{"Other/New.epub", "Other/New.epub"},
+		}
+		for _, c := range checks {
+			if got := k.CheckLpath(c.lpath); got != c.want {
+				t.Errorf("CheckLpath(%q) = %q, want %q", c.lpath, got, c.want)
+			}
+		}
+		// A file in place of a directory can't be avoided with a suffix
+		if err = ioutil.WriteFile(filepath.Join(dir, "Blocked"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := k.CheckLpath("Blocked/Book.epub"); got != "Blocked/Book.epub" {
+			t.Errorf("CheckLpath(%q) = %q, want it unchanged", "Blocked/Book.epub", got)
+		}
+		blocked := uc.CalibreBookMeta{Lpath: "blocked/Book.epub", UUID: "d"}
+		if _, _, err := k.BookLpath(&blocked); err == nil {
+			t.Errorf("BookLpath(%q) succeeded, want an error", blocked.Lpath)
+		}
+		// The renamed book turns out to be the same book, by UUID
+		md := uc.CalibreBookMeta{Lpath: "Author/Book (1).epub", UUID: "a"}
+		if lp, req, _ := k.BookLpath(&md); lp != "Author/book.epub" || req != "Author/Book.epub" {
+			t.Errorf("BookLpath = %q, %q, want the existing book", lp, req)
+		}
+		if got := k.ResolveLpath("Author/Book (1).epub"); got != "Author/book.epub" {
+			t.Errorf("ResolveLpath = %q", got)
+		}
+		// A different book with the same lpath is not overwritten
+		md = uc.CalibreBookMeta{Lpath: "Author/book.epub", UUID: "c"}
+		if lp, req, _ := k.BookLpath(&md); lp != "Author/book (1).epub" || req != "Author/book.epub" {
+			t.Errorf("BookLpath = %q, %q, want a new lpath", lp, req)
+		}
+	}
+}
+
+func TestMigrateBookSQL(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	const oldCID, newCID = "file:///mnt/onboard/A_b/book.kepub.epub", "file:///mnt/sd/A_b/book.kepub.epub"
+	setup := []string{
+		`CREATE TABLE content (ContentID TEXT, ContentType INTEGER, BookID TEXT, ImageId TEXT);`,
+		`CREATE TABLE Bookmark (ContentID TEXT, VolumeID TEXT);`,
+		`CREATE TABLE ShelfContent (ContentId TEXT);`,
+		`INSERT INTO content VALUES ('` + oldCID + `', 6, NULL, 'old');`,
+		`INSERT INTO content VALUES ('` + oldCID + `!OEBPS!ch1.xhtml', 9, '` + oldCID + `', NULL);`,
+		`INSERT INTO content VALUES ('file:///mnt/onboard/AXb/book.kepub.epub', 6, NULL, 'other');`,
+		`INSERT INTO content VALUES ('` + newCID + `', 6, NULL, 'stale');`,
+		`INSERT INTO Bookmark VALUES ('` + oldCID + `!OEBPS!ch1.xhtml', '` + oldCID + `');`,
+		`INSERT INTO ShelfContent VALUES ('` + oldCID + `');`,
+	}
+	for _, q := range setup {
+		if _, err = db.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	cols, err := existingColumns(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries, err := migrateBookSQL(cols, oldCID, newCID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Applying the migration twice must not lose anything
+	for i := 0; i < 2; i++ {
+		for _, q := range queries {
+			if _, err = db.Exec(q); err != nil {
+				t.Fatalf("%s: %v", q, err)
+			}
+		}
+	}
+	count := func(q string) int {
+		var n int
+		if err := db.QueryRow(q).Scan(&n); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		return n
+	}
+	checks := map[string]int{
+		`SELECT COUNT(*) FROM content WHERE ContentID GLOB 'file:///mnt/onboard/A_b/*'`:                                      0,
+		`SELECT COUNT(*) FROM content WHERE ContentID = 'file:///mnt/onboard/AXb/book.kepub.epub'`:                           1,
+		`SELECT COUNT(*) FROM content WHERE ContentID = '` + newCID + `' AND ImageId = 'file____mnt_sd_A_b_book_kepub_epub'`: 1,
+		`SELECT COUNT(*) FROM content WHERE ContentID = '` + newCID + `!OEBPS!ch1.xhtml' AND BookID = '` + newCID + `'`:      1,
+		`SELECT COUNT(*) FROM Bookmark WHERE ContentID = '` + newCID + `!OEBPS!ch1.xhtml' AND VolumeID = '` + newCID + `'`:   1,
+		`SELECT COUNT(*) FROM ShelfContent WHERE ContentId = '` + newCID + `'`:                                               1,
+	}
+	for q, want := range checks {
+		if got := count(q); got != want {
+			t.Errorf("%s = %d, want %d", q, got, want)
+		}
+	}
+}
+
+func TestMDentryRoundTrip(t *testing.T) {
+	raw := json.RawMessage(`{"lpath": "a/b.epub", "title": "B", "uuid": "1234", "size": 10, "kobotouch_extra": {"x": [1, 2]}, "other": null}`)
+	e, err := decodeMDentry(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.extra) != 2 || string(e.extra["kobotouch_extra"]) != `{"x": [1, 2]}` {
+		t.Fatalf("unexpected extra fields: %v", e.extra)
+	}
+	e.md.Title = "Changed"
+	out, err := e.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err = json.Unmarshal(out, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["title"] != "Changed" || fields["uuid"] != "1234" {
+		t.Errorf("known fields not encoded: %s", out)
+	}
+	if _, ok := fields["other"]; !ok {
+		t.Errorf("null extra field dropped: %s", out)
+	}
+	if x, ok := fields["kobotouch_extra"].(map[string]interface{}); !ok || len(x["x"].([]interface{})) != 2 {
+		t.Errorf("extra field not preserved: %s", out)
+	}
+}
+
+func TestMDentriesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ku-md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, calibreMDfile)
+	var entries []mdEntry
+	for i := 0; i < 3; i++ {
+		e := mdEntry{md: uc.CalibreBookMeta{Lpath: fmt.Sprintf("book%d.epub", i), Title: fmt.Sprintf("Book %d", i)}}
+		if i == 1 {
+			e.extra = map[string]json.RawMessage{"kobo_extra": json.RawMessage(`"x"`)}
+		}
+		entries = append(entries, e)
+	}
+	for _, want := range [][]mdEntry{entries, nil} {
+		err = writeMDentries(fn, func(write func(mdEntry) error) error {
+			for _, e := range want {
+				if err := write(e); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []mdEntry
+		if err = readMDentries(fn, func(e mdEntry) error { got = append(got, e); return nil }); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("read %d entries, want %d", len(got), len(want))
+		}
+		for i := range got {
+			if got[i].md.Lpath != want[i].md.Lpath || got[i].md.Title != want[i].md.Title || len(got[i].extra) != len(want[i].extra) {
+				t.Errorf("entry %d: got %+v, want %+v", i, got[i], want[i])
+			}
+		}
+	}
+	if _, err = os.Stat(fn + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind")
+	}
+}
+
+func TestSeriesMatcher(t *testing.T) {
+	m := &seriesMatcher{
+		aliases: map[string]string{"leviathan wakes": "Expanse"},
+		store:   make(map[string]storeSeries),
+	}
+	m.addStoreSeries(storeSeries{Name: "The Expanse", ID: "abc-123"})
+	m.addStoreSeries(storeSeries{Name: "Expanse, The", ID: "def-456"})
+	tests := []struct{ series, name, id string }{
+		{"Expanse Series", "The Expanse", "abc-123"},
+		{"Leviathan Wakes", "The Expanse", "abc-123"},
+		{"Discworld", "Discworld", "Discworld"},
+	}
+	for _, tc := range tests {
+		if name, id := m.match(tc.series); name != tc.name || id != tc.id {
+			t.Errorf("match(%q) = %q, %q, want %q, %q", tc.series, name, id, tc.name, tc.id)
+		}
+	}
+}
+
+func TestNickelFieldsSQL(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Exec(`
+		CREATE TABLE content (ContentID TEXT PRIMARY KEY, Title TEXT, Attribution TEXT, Publisher TEXT, DateCreated TEXT, Language TEXT, ISBN TEXT);
+		CREATE TABLE ratings (ContentID TEXT NOT NULL, Rating INTEGER, DateModified TEXT NOT NULL, PRIMARY KEY (ContentID));
+		INSERT INTO content (ContentID, Title) VALUES ('file:///mnt/onboard/a.epub', 'a');`); err != nil {
+		t.Fatal(err)
+	}
+	pub, rating := "O'Reilly", 8.0
+	pubdate := uc.ConvertTime(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC))
+	md := uc.CalibreBookMeta{
+		Title: "A Book", Authors: []string{"A. Author", "B. Author"}, Publisher: &pub, Pubdate: &pubdate,
+		Languages: []string{"eng"}, Identifiers: map[string]string{"isbn": "9780000000000"}, Rating: &rating,
+	}
+	opts := nickelFieldOptions{Title: true, Authors: true, Publisher: true, PubDate: true, Language: true, ISBN: true, Rating: true}
+	dialect := goqu.Dialect("sqlite3")
+	rec := goqu.Record{}
+	addNickelFields(rec, &md, opts)
+	cid := "file:///mnt/onboard/a.epub"
+	q, _, err := dialect.Update("content").Set(rec).Where(goqu.Ex{"ContentID": cid}).ToSQL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rq, err := nickelRatingSQL(dialect, cid, &md, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The rating query must also work if the book already has a rating
+	for _, query := range []string{q, rq, rq} {
+		if _, err = db.Exec(query); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+	var title, attr, publisher, created, lang, isbn string
+	var stars int
+	err = db.QueryRow(`SELECT Title, Attribution, Publisher, DateCreated, Language, ISBN, r.Rating FROM content
+		JOIN ratings r USING (ContentID)`).Scan(&title, &attr, &publisher, &created, &lang, &isbn, &stars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []interface{}{title, attr, publisher, created, lang, isbn, stars}
+	want := []interface{}{"A Book", "A. Author, B. Author", "O'Reilly", "2020-05-01T00:00:00Z", "en", "9780000000000", 4}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// A book that isn't rated in Calibre keeps the rating set on the Kobo
+	md.Rating = nil
+	if rq, err = nickelRatingSQL(dialect, cid, &md, time.Now()); err != nil || rq != "" {
+		t.Errorf("nickelRatingSQL(unrated) = %q, %v, want no query", rq, err)
+	}
+}
+
+func TestCollectionsSQL(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Exec(`
+		CREATE TABLE content (ContentID TEXT PRIMARY KEY, ContentType INTEGER, ReadStatus INTEGER);
+		CREATE TABLE Shelf (CreationDate TEXT, Id TEXT, InternalName TEXT, LastModified TEXT, Name TEXT, Type TEXT,
+			_IsDeleted BOOL, _IsVisible BOOL, _IsSynced BOOL, PRIMARY KEY (Id));
+		CREATE TABLE ShelfContent (ShelfName TEXT, ContentId TEXT, DateModified TEXT, _IsDeleted BOOL, _IsSynced BOOL,
+			PRIMARY KEY (ShelfName, ContentId));
+		INSERT INTO content VALUES ('file:///mnt/onboard/a.epub', 6, 0), ('file:///mnt/onboard/b.epub', 6, 1);
+		INSERT INTO Shelf (Id, InternalName, Name, _IsDeleted, _IsVisible) VALUES ('1', 'Fantasy', 'Fantasy', 'true', 'false');`); err != nil {
+		t.Fatal(err)
+	}
+	series := "Discworld"
+	read := uc.CalibreBookMeta{
+		Tags: []string{"Fantasy", " "}, Series: &series,
+		UserMetadata: map[string]uc.CalibreCustomColumn{
+			"#shelves": {Value: []interface{}{"Favourites", "Fantasy"}},
+			"#read":    {Value: true},
+		},
+	}
+	unread := uc.CalibreBookMeta{Tags: []string{"Fantasy"}}
+	cols := []string{"tags", "series", "#shelves", "#missing"}
+	if got, want := collectionNames(&read, cols), []string{"Fantasy", "Discworld", "Favourites"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("collectionNames() = %q, want %q", got, want)
+	}
+	dialect := goqu.Dialect("sqlite3")
+	var queries []string
+	for cid, md := range map[string]*uc.CalibreBookMeta{"file:///mnt/onboard/a.epub": &read, "file:///mnt/onboard/b.epub": &unread} {
+		for _, name := range collectionNames(md, cols) {
+			q, err := nickelShelfSQL(dialect, name, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			cq, err := nickelShelfContentSQL(dialect, cid, name, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			queries = append(append(queries, q...), cq)
+		}
+		rq, err := nickelReadStatusSQL(dialect, cid, md, "#read")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rq != "" {
+			queries = append(queries, rq)
+		}
+	}
+	// Sending the books again must not add anything twice
+	for i := 0; i < 2; i++ {
+		for _, q := range queries {
+			if _, err = db.Exec(q); err != nil {
+				t.Fatalf("%s: %v", q, err)
+			}
+		}
+	}
+	checks := map[string]int{
+		`SELECT COUNT(*) FROM Shelf`: 3,
+		`SELECT COUNT(*) FROM Shelf WHERE InternalName = 'Fantasy' AND _IsDeleted = 'false' AND _IsVisible = 'true'`: 1,
+		`SELECT COUNT(*) FROM ShelfContent`:                                             4,
+		`SELECT ReadStatus FROM content WHERE ContentID = 'file:///mnt/onboard/a.epub'`: 2,
+		`SELECT ReadStatus FROM content WHERE ContentID = 'file:///mnt/onboard/b.epub'`: 1,
+	}
+	for q, want := range checks {
+		var got int
+		if err = db.QueryRow(q).Scan(&got); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		if got != want {
+			t.Errorf("%s = %d, want %d", q, got, want)
+		}
+	}
+}
+
+func TestSessionGuards(t *testing.T) {
+	k := &Kobo{}
+	if err := k.startSession(); err != nil {
+		t.Fatalf("startSession() = %v", err)
+	}
+	if _, err := k.MigrateBooks(storageSD, nil); !errors.Is(err, ErrSessionStarted) {
+		t.Errorf("MigrateBooks() after start = %v, want %v", err, ErrSessionStarted)
+	}
+	if err := k.startSession(); !errors.Is(err, ErrSessionStarted) {
+		t.Errorf("startSession() twice = %v, want %v", err, ErrSessionStarted)
+	}
+	k = &Kobo{migrationPending: true}
+	if err := k.startSession(); !errors.Is(err, ErrMigrationPending) {
+		t.Errorf("startSession() after moving books = %v, want %v", err, ErrMigrationPending)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2019-2020 Sherman Perry
+
+// This file is part of Kobo UNCaGED.
+
+// Kobo UNCaGED is free software: you can redistribute it and/or modify
+// it under the terms of the Affero GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Kobo UNCaGED is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with Kobo UNCaGED.  If not, see <https://www.gnu.org/licenses/>.
+
+package device
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/kulog"
+)
+
+// eventSchemaVersion is the version of the web UI event format. It must be
+// incremented whenever an existing event or payload changes incompatibly.
+// The format is documented in docs/web-events.md
+const eventSchemaVersion = 1
+
+// eventEnvelope wraps the payload of every event sent to the web UI
+type eventEnvelope struct {
+	Version int         `json:"version"`
+	Type    string      `json:"type"`
+	Seq     uint64      `json:"seq"`
+	Payload interface{} `json:"payload"`
+}
+
+// webEvent is a single server sent event
+type webEvent struct {
+	id   uint64
+	name string
+	data string
+}
+
+// eventSub is a single subscriber (usually a browser tab) to the event bus
+type eventSub struct {
+	ch        chan webEvent
+	delivered uint64
+}
+
+// eventBus broadcasts events to any number of web UI subscribers, including none.
+// Publishing never blocks. Recent events are kept so that a browser that reconnects
+// (or reloads the page) can catch up. A subscriber that falls too far behind is
+// disconnected, and catches up from the history when it reconnects.
+//
+// Sticky events are used for dialogs waiting on a response from the user. They are
+// replayed to every new subscriber until they are cleared, rather than being kept in
+// the history, so that a dialog is never shown again once it has been answered.
+type eventBus struct {
+	mux     sync.Mutex
+	nextID  uint64
+	history []webEvent
+	histMax int
+	sticky  map[string]webEvent
+	subs    map[*eventSub]struct{}
+	bufSize int
+}
+
+func newEventBus(historySize, bufSize int) *eventBus {
+	return &eventBus{
+		nextID:  1,
+		histMax: historySize,
+		sticky:  make(map[string]webEvent),
+		subs:    make(map[*eventSub]struct{}),
+		bufSize: bufSize,
+	}
+}
+
+// send delivers ev to all subscribers. The caller must hold b.mux
+func (b *eventBus) send(ev webEvent) {
+	for sub := range b.subs {
+		select {
+		case sub.ch <- ev:
+		default:
+			// Too far behind. Disconnect, and let the browser catch up when it reconnects
+			close(sub.ch)
+			delete(b.subs, sub)
+		}
+	}
+}
+
+// newEvent wraps payload in an envelope. The caller must hold b.mux
+func (b *eventBus) newEvent(evType string, payload interface{}) (webEvent, error) {
+	// Note, json.Marshal never emits newlines, so the data is safe to send as a single SSE data line
+	data, err := json.Marshal(eventEnvelope{Version: eventSchemaVersion, Type: evType, Seq: b.nextID, Payload: payload})
+	if err != nil {
+		return webEvent{}, fmt.Errorf("newEvent: error encoding '%s' event: %w", evType, err)
+	}
+	ev := webEvent{id: b.nextID, name: evType, data: string(data)}
+	b.nextID++
+	return ev, nil
+}
+
+// publish sends an event to all subscribers, and adds it to the history. It returns the
+// event ID, or zero if the event could not be encoded.
+func (b *eventBus) publish(evType string, payload interface{}) uint64 {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	ev, err := b.newEvent(evType, payload)
+	if err != nil {
+		kulog.Err(err)
+		return 0
+	}
+	b.history = append(b.history, ev)
+	if len(b.history) > b.histMax {
+		b.history = b.history[len(b.history)-b.histMax:]
+	}
+	b.send(ev)
+	return ev.id
+}
+
+// publishSticky sends an event to all subscribers, and replays it to new subscribers until cleared
+func (b *eventBus) publishSticky(evType string, payload interface{}) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	ev, err := b.newEvent(evType, payload)
+	if err != nil {
+		kulog.Err(err)
+		return
+	}
+	b.sticky[evType] = ev
+	b.send(ev)
+}
+
+// clearSticky stops a sticky event being replayed to new subscribers
+func (b *eventBus) clearSticky(evType string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	delete(b.sticky, evType)
+}
+
+// subscribe registers a new subscriber. Events from the history newer than lastID,
+// followed by any sticky events, are returned to be sent before anything from the channel.
+func (b *eventBus) subscribe(lastID uint64) (*eventSub, []webEvent) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	sub := &eventSub{ch: make(chan webEvent, b.bufSize), delivered: lastID}
+	replay := make([]webEvent, 0, len(b.history)+len(b.sticky))
+	for _, ev := range b.history {
+		if ev.id > lastID {
+			replay = append(replay, ev)
+		}
+	}
+	for _, ev := range b.sticky {
+		replay = append(replay, ev)
+	}
+	b.subs[sub] = struct{}{}
+	return sub, replay
+}
+
+// unsubscribe removes a subscriber
+func (b *eventBus) unsubscribe(sub *eventSub) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if _, exists := b.subs[sub]; exists {
+		close(sub.ch)
+		delete(b.subs, sub)
+	}
+}
+
+// markDelivered records that a subscriber has sent everything up to id to the browser
+func (b *eventBus) markDelivered(sub *eventSub, id uint64) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if id > sub.delivered {
+		sub.delivered = id
+	}
+}
+
+// flush waits until every subscriber has delivered the event with the given id, or the
+// timeout expires. It returns false on timeout.
+func (b *eventBus) flush(id uint64, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		b.mux.Lock()
+		done := true
+		for sub := range b.subs {
+			if sub.delivered < id {
+				done = false
+				break
+			}
+		}
+		b.mux.Unlock()
+		if done {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
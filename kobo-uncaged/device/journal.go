@@ -0,0 +1,163 @@
+// Copyright 2019-2020 Sherman Perry
+
+// This file is part of Kobo UNCaGED.
+
+// Kobo UNCaGED is free software: you can redistribute it and/or modify
+// it under the terms of the Affero GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Kobo UNCaGED is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with Kobo UNCaGED.  If not, see <https://www.gnu.org/licenses/>.
+
+package device
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/kulog"
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+const kuTransferJournal = ".adds/kobo-uncaged/transfer-journal.json"
+
+// partSuffix is appended to the name of a book while it is being received
+const partSuffix = ".part"
+
+// journalEntry is a book that was received, but may not be in metadata.calibre yet
+type journalEntry struct {
+	Metadata uc.CalibreBookMeta `json:"metadata"`
+	Info     bookInfo           `json:"info"`
+}
+
+// transferJournal keeps track of books received since metadata.calibre was last
+// written. metadata.calibre is only written after the last book of a batch, so if the
+// connection drops part way through a batch, the journal lets us remember the books
+// that were received, rather than Calibre sending them all again. Partially received
+// books are discarded, as Calibre always sends a book from the start.
+type transferJournal struct {
+	InProgress string                  `json:"inProgress"`
+	Completed  map[string]journalEntry `json:"completed"`
+}
+
+// PartPath returns the path a book is written to while it is being received
+func PartPath(bkPath string) string {
+	return bkPath + partSuffix
+}
+
+func (k *Kobo) writeJournal() error {
+	if err := util.WriteJSON(filepath.Join(k.DBRootDir, kuTransferJournal), k.journal); err != nil {
+		return fmt.Errorf("writeJournal: %w", err)
+	}
+	return nil
+}
+
+// JournalStart records that a book is being received
+func (k *Kobo) JournalStart(cid string) error {
+	k.journalMux.Lock()
+	defer k.journalMux.Unlock()
+	k.journal.InProgress = cid
+	return k.writeJournal()
+}
+
+// JournalComplete records that a book was received successfully. SetBookInfo must be called first.
+func (k *Kobo) JournalComplete(cid string, md uc.CalibreBookMeta) error {
+	k.mdMux.RLock()
+	info := k.bookInfo[cid]
+	k.mdMux.RUnlock()
+	k.journalMux.Lock()
+	defer k.journalMux.Unlock()
+	k.journal.InProgress = ""
+	k.journal.Completed[cid] = journalEntry{Metadata: md, Info: info}
+	return k.writeJournal()
+}
+
+// JournalAbort records that receiving a book failed
+func (k *Kobo) JournalAbort(cid string) error {
+	k.journalMux.Lock()
+	defer k.journalMux.Unlock()
+	if k.journal.InProgress != cid {
+		return nil
+	}
+	k.journal.InProgress = ""
+	return k.writeJournal()
+}
+
+// clearJournal empties the journal, once metadata.calibre is up to date
+func (k *Kobo) clearJournal() error {
+	k.journalMux.Lock()
+	defer k.journalMux.Unlock()
+	if k.journal.InProgress == "" && len(k.journal.Completed) == 0 {
+		return nil
+	}
+	k.journal.Completed = make(map[string]journalEntry)
+	if k.journal.InProgress != "" {
+		// Still receiving a book, so the journal must be kept
+		return k.writeJournal()
+	}
+	if err := os.Remove(filepath.Join(k.DBRootDir, kuTransferJournal)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("clearJournal: %w", err)
+	}
+	return nil
+}
+
+// recoverJournal reads the journal left by a previous session. Any partially received
+// book is removed, and books that were received completely are added to store and bi.
+// It returns the content IDs of the recovered books.
+func (k *Kobo) recoverJournal(store mdStore, bi map[string]bookInfo) ([]string, error) {
+	var j transferJournal
+	emptyOrNotExist, err := util.ReadJSON(filepath.Join(k.DBRootDir, kuTransferJournal), &j)
+	if err != nil {
+		kulog.Warnf("%v", err)
+		return nil, nil
+	} else if emptyOrNotExist {
+		return nil, nil
+	}
+	if j.InProgress != "" {
+		bkPath := util.ContentIDtoBkPath(k.BKRootDir, j.InProgress, string(k.ContentIDprefix))
+		kulog.Infof("Removing partially received book: %s", bkPath)
+		if err = os.Remove(PartPath(bkPath)); err != nil && !os.IsNotExist(err) {
+			kulog.Err(err)
+		}
+	}
+	var recovered []string
+	for cid, entry := range j.Completed {
+		bkPath := util.ContentIDtoBkPath(k.BKRootDir, cid, string(k.ContentIDprefix))
+		if _, err := os.Stat(bkPath); err != nil {
+			// Deleted since, or on the other storage
+			continue
+		}
+		kulog.Infof("Recovering book received in an interrupted session: %s", cid)
+		e, _, err := store.get(cid)
+		if err != nil {
+			return nil, fmt.Errorf("recoverJournal: %w", err)
+		}
+		e.md = entry.Metadata
+		if err = store.put(cid, e); err != nil {
+			return nil, fmt.Errorf("recoverJournal: %w", err)
+		}
+		bi[cid] = entry.Info
+		recovered = append(recovered, cid)
+	}
+	if len(recovered) == 0 {
+		if err = os.Remove(filepath.Join(k.DBRootDir, kuTransferJournal)); err != nil && !os.IsNotExist(err) {
+			kulog.Err(err)
+		}
+		return nil, nil
+	}
+	// Keep the recovered books in the journal, until they are written to metadata.calibre
+	k.journalMux.Lock()
+	for _, cid := range recovered {
+		k.journal.Completed[cid] = j.Completed[cid]
+	}
+	k.journalMux.Unlock()
+	return recovered, nil
+}
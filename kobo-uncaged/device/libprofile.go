@@ -0,0 +1,151 @@
+// Copyright 2019-2020 Sherman Perry
+
+// This file is part of Kobo UNCaGED.
+
+// Kobo UNCaGED is free software: you can redistribute it and/or modify
+// it under the terms of the Affero GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Kobo UNCaGED is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with Kobo UNCaGED.  If not, see <https://www.gnu.org/licenses/>.
+
+package device
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/kulog"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// withLibOptions returns a copy of opts, with the options set in the profile of the
+// library uuid overriding the global options
+func (opts *KuOptions) withLibOptions(uuid string) *KuOptions {
+	eff := *opts
+	lo, exists := opts.LibOptions[uuid]
+	if !exists {
+		return &eff
+	}
+	if lo.PreferSDCard != nil {
+		eff.PreferSDCard = *lo.PreferSDCard
+	}
+	if lo.PreferKepub != nil {
+		eff.PreferKepub = *lo.PreferKepub
+	}
+	if lo.Thumbnail != nil {
+		eff.Thumbnail = *lo.Thumbnail
+		eff.Thumbnail.SetRezFilter()
+	}
+	if lo.LpathTemplate != nil {
+		eff.LpathTemplate = *lo.LpathTemplate
+	}
+	return &eff
+}
+
+// validateLibOptions checks the options of each library profile, and fills in defaults
+// for any thumbnail options that are missing
+func validateLibOptions(libOpts map[string]KuLibOptions) error {
+	for uuid, lo := range libOpts {
+		if lo.LpathTemplate != nil {
+			if err := validateLpathTemplate(*lo.LpathTemplate); err != nil {
+				return fmt.Errorf("validateLibOptions: %s: %w", lo.LibraryName, err)
+			}
+		}
+		if lo.Thumbnail != nil {
+			lo.Thumbnail.Validate()
+		}
+		fm, err := validateFieldMap(lo.FieldMap)
+		if err != nil {
+			return fmt.Errorf("validateLibOptions: %s: %w", lo.LibraryName, err)
+		}
+		if err = validateLibColumns(lo); err != nil {
+			return fmt.Errorf("validateLibOptions: %s: %w", lo.LibraryName, err)
+		}
+		lo.FieldMap = fm
+		libOpts[uuid] = lo
+	}
+	return nil
+}
+
+// config returns a copy of the user options. cfgMux guards the parts of KuConfig that
+// change while Calibre is connected: LibOptions, LastLibrary and LibInfo. LibOptions is
+// replaced rather than modified, so the copy may be read without holding cfgMux.
+func (k *Kobo) config() KuOptions {
+	k.cfgMux.RLock()
+	defer k.cfgMux.RUnlock()
+	return *k.KuConfig
+}
+
+// opts returns the user options, with the profile of the current library applied. The
+// options returned are replaced rather than modified when the library changes.
+func (k *Kobo) opts() *KuOptions {
+	k.cfgMux.RLock()
+	defer k.cfgMux.RUnlock()
+	return k.effOpts
+}
+
+// notice returns the profile options of the current library that can't be applied until
+// the next connection, if any
+func (k *Kobo) notice() string {
+	k.cfgMux.RLock()
+	defer k.cfgMux.RUnlock()
+	return k.libNotice
+}
+
+// currentLibrary returns the Calibre library KU is connected to, and its profile
+func (k *Kobo) currentLibrary() (uc.CalibreLibraryInfo, KuLibOptions) {
+	k.cfgMux.RLock()
+	defer k.cfgMux.RUnlock()
+	return k.LibInfo, k.KuConfig.LibOptions[k.LibInfo.LibraryUUID]
+}
+
+// updateLibOptions changes the profile of the library uuid. The caller must hold cfgMux.
+func (k *Kobo) updateLibOptions(uuid string, update func(lo *KuLibOptions)) {
+	libOpts := make(map[string]KuLibOptions, len(k.KuConfig.LibOptions)+1)
+	for id, lo := range k.KuConfig.LibOptions {
+		libOpts[id] = lo
+	}
+	lo := libOpts[uuid]
+	update(&lo)
+	libOpts[uuid] = lo
+	k.KuConfig.LibOptions = libOpts
+}
+
+// SetLibraryInfo records the Calibre library KU is connected to, and applies its profile
+func (k *Kobo) SetLibraryInfo(li uc.CalibreLibraryInfo) {
+	k.cfgMux.Lock()
+	defer k.cfgMux.Unlock()
+	k.LibInfo = li
+	// Every library gets a profile, so it can be chosen in the web UI
+	k.updateLibOptions(li.LibraryUUID, func(lo *KuLibOptions) {
+		lo.LibraryName = li.LibraryName
+	})
+	k.KuConfig.LastLibrary = li.LibraryUUID
+	prev := k.effOpts
+	// Covers are generated using the new options from here on
+	k.effOpts = k.KuConfig.withLibOptions(li.LibraryUUID)
+	// The storage is chosen, and the preferred formats and cover size are sent to Calibre, before
+	// Calibre says which library it is connecting from, so they stay as they were for this session
+	var pending []string
+	if prev.PreferSDCard != k.effOpts.PreferSDCard {
+		pending = append(pending, "storage")
+	}
+	if prev.PreferKepub != k.effOpts.PreferKepub {
+		pending = append(pending, "preferred format")
+	}
+	if prev.Thumbnail.GenerateLevel != k.effOpts.Thumbnail.GenerateLevel {
+		pending = append(pending, "cover size sent by Calibre")
+	}
+	k.libNotice = ""
+	if len(pending) > 0 {
+		k.libNotice = fmt.Sprintf("The %s for this library will be used from the next connection.", strings.Join(pending, ", "))
+		kulog.Infof("%s: %s", li.LibraryName, k.libNotice)
+	}
+}
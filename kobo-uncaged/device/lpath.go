@@ -0,0 +1,264 @@
+// Copyright 2019-2020 Sherman Perry
+
+// This file is part of Kobo UNCaGED.
+
+// Kobo UNCaGED is free software: you can redistribute it and/or modify
+// it under the terms of the Affero GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Kobo UNCaGED is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with Kobo UNCaGED.  If not, see <https://www.gnu.org/licenses/>.
+
+package device
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/kulog"
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// defaultSanitizeProfile is the filename sanitization profile used if none is set
+const defaultSanitizeProfile = util.SanitizeFAT
+
+// validateLpathTemplate checks that tmpl is a usable lpath template. The empty template is
+// valid, and means the lpath Calibre provides is used.
+func validateLpathTemplate(tmpl string) error {
+	if strings.TrimSpace(tmpl) == "" {
+		return nil
+	}
+	t, err := parseTemplate(tmpl)
+	if err != nil {
+		return err
+	}
+	if !t.hasFields() {
+		return fmt.Errorf("validateLpathTemplate: template must use at least one field")
+	}
+	return nil
+}
+
+// expandLpathTemplate builds an lpath (without extension) for md from tmpl. Field values
+// cannot create directories, so any slashes in them are replaced.
+func expandLpathTemplate(tmpl string, md *uc.CalibreBookMeta) (string, error) {
+	t, err := parseTemplate(tmpl)
+	if err != nil {
+		return "", err
+	}
+	return t.expand(md, func(field, val string) string {
+		if val == "" && (field == "title" || field == "authors" || field == "author_sort") {
+			val = "Unknown"
+		}
+		return strings.NewReplacer("/", "_", "\\", "_").Replace(val)
+	}), nil
+}
+
+// SanitizeLpath converts kepub lpaths to the form Nickel requires, and makes lpath safe to
+// use on the device using the configured sanitization profile
+func (k *Kobo) SanitizeLpath(lpath string) string {
+	return util.SanitizeLpath(util.LpathKepubConvert(lpath), k.KuConfig.SanitizeProfile)
+}
+
+// TemplateLpath returns the lpath a new book should be saved to, using the configured lpath
+// template and the extension of lpath. lpath is returned unchanged if no template is set.
+func (k *Kobo) TemplateLpath(lpath string, md *uc.CalibreBookMeta) string {
+	tmpl := k.opts().LpathTemplate
+	if strings.TrimSpace(tmpl) == "" {
+		return lpath
+	}
+	lp, err := expandLpathTemplate(tmpl, md)
+	if err != nil {
+		// The template is validated when the config is loaded, so this shouldn't happen
+		return lpath
+	}
+	return k.SanitizeLpath(lp + util.LpathExt(lpath))
+}
+
+// SetLpathAlias records that a book Calibre knows as calLpath was saved to lpath instead.
+// Calibre is only told the new lpath the next time it connects, so until then, any
+// reference to calLpath is translated with ResolveLpath.
+func (k *Kobo) SetLpathAlias(calLpath, lpath string) {
+	k.mdMux.Lock()
+	defer k.mdMux.Unlock()
+	k.lpathAliases[calLpath] = lpath
+}
+
+// ResolveLpath returns the lpath a book known to Calibre as lpath was saved to
+func (k *Kobo) ResolveLpath(lpath string) string {
+	k.mdMux.RLock()
+	defer k.mdMux.RUnlock()
+	if lp, ok := k.lpathAliases[lpath]; ok {
+		return lp
+	}
+	return lpath
+}
+
+// lpathKey folds lpath for comparison, as the FAT and exFAT filesystems are case insensitive
+func lpathKey(lpath string) string {
+	return strings.ToLower(util.ComposeNFC(lpath))
+}
+
+// maxLpathSuffix is the highest " (n)" suffix uniqueLpath tries before giving up
+const maxLpathSuffix = 100
+
+// lpathOnDisk reports whether a file exists at lpath, ignoring case and Unicode normalization,
+// as the filesystem would when the book is saved. It is an error for a directory of lpath to
+// be a file, as no filename in that directory can be used.
+func (k *Kobo) lpathOnDisk(lpath string) (bool, error) {
+	dir := k.BKRootDir
+	names := strings.Split(lpath, "/")
+	for i, name := range names {
+		fi, err := os.Lstat(filepath.Join(dir, name))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return false, fmt.Errorf("lpathOnDisk: %w", err)
+			}
+			entries, err := ioutil.ReadDir(dir)
+			if err != nil {
+				return false, fmt.Errorf("lpathOnDisk: %w", err)
+			}
+			fi = nil
+			for _, e := range entries {
+				if lpathKey(e.Name()) == lpathKey(name) {
+					fi = e
+					break
+				}
+			}
+			if fi == nil {
+				return false, nil
+			}
+		}
+		dir = filepath.Join(dir, fi.Name())
+		if i < len(names)-1 && !fi.IsDir() {
+			return false, fmt.Errorf("lpathOnDisk: '%s' is not a directory", strings.Join(names[:i+1], "/"))
+		}
+	}
+	return true, nil
+}
+
+// uniqueLpath checks lpath against the books already on the device. If it is the same as the
+// lpath of a book on a case insensitive filesystem, and sameBook reports that it is the same
+// book, the lpath of that book is returned. Otherwise, if it would overwrite a different book,
+// or a file KU doesn't manage, a " (n)" suffix is added before the extension.
+func (k *Kobo) uniqueLpath(lpath string, sameBook func(md uc.CalibreBookMeta, info bookInfo) bool) (string, error) {
+	k.mdMux.RLock()
+	defer k.mdMux.RUnlock()
+	check := func(lp string) (string, bool, error) {
+		books, err := k.md.byLpathKey(lpathKey(lp))
+		if err != nil {
+			return lp, false, err
+		}
+		for cid, e := range books {
+			if sameBook(e.md, k.bookInfo[cid]) {
+				return e.md.Lpath, true, nil
+			}
+		}
+		if len(books) > 0 {
+			return lp, false, nil
+		}
+		exists, err := k.lpathOnDisk(lp)
+		return lp, !exists, err
+	}
+	lp, ok, err := check(lpath)
+	if err != nil {
+		return "", fmt.Errorf("uniqueLpath: %w", err)
+	} else if ok {
+		return lp, nil
+	}
+	ext := util.LpathExt(lpath)
+	stem := []rune(strings.TrimSuffix(lpath, ext))
+	for n := 1; n <= maxLpathSuffix; n++ {
+		suffix := fmt.Sprintf(" (%d)", n) + ext
+		cand := k.SanitizeLpath(string(stem) + suffix)
+		// Make room for the suffix if the lpath had to be shortened
+		for s := stem; !strings.HasSuffix(cand, suffix) && len(s) > 0; {
+			s = s[:len(s)-1]
+			cand = k.SanitizeLpath(string(s) + suffix)
+		}
+		lp, ok, err := check(cand)
+		if err != nil {
+			return "", fmt.Errorf("uniqueLpath: %w", err)
+		} else if ok {
+			kulog.Infof("'%s' would overwrite another book, using '%s' instead", lpath, lp)
+			return lp, nil
+		}
+	}
+	return "", fmt.Errorf("uniqueLpath: no free lpath found for '%s'", lpath)
+}
+
+// CheckLpath sanitizes an lpath from Calibre, and makes sure it doesn't collide with a different
+// book already on the device. Only the lpath is known at this point, so a book already saved to
+// the same lpath is assumed to be the same book, unless Calibre requested a different lpath for it.
+// If no free lpath can be found, the sanitized lpath is returned, and BookLpath refuses the book
+// if it is sent.
+func (k *Kobo) CheckLpath(lpath string) string {
+	lp := k.SanitizeLpath(lpath)
+	newLp, err := k.uniqueLpath(lp, func(md uc.CalibreBookMeta, info bookInfo) bool {
+		return md.Lpath == lp && (info.RequestedLpath == "" || info.RequestedLpath == lpath)
+	})
+	if err != nil {
+		kulog.Warnf("CheckLpath: %v", err)
+		return lp
+	}
+	if newLp != lpath {
+		k.mdMux.Lock()
+		k.requestedLpaths[newLp] = lpath
+		k.mdMux.Unlock()
+	}
+	return newLp
+}
+
+// BookLpath decides where a book received from Calibre is saved, using the lpath template for
+// new books, and making sure a different book isn't overwritten. requested is the lpath Calibre
+// originally asked for, if the book is saved anywhere else.
+func (k *Kobo) BookLpath(md *uc.CalibreBookMeta) (lpath, requested string, err error) {
+	calLpath := md.Lpath
+	k.mdMux.RLock()
+	requested, ok := k.requestedLpaths[calLpath]
+	alias, aliased := k.lpathAliases[calLpath]
+	k.mdMux.RUnlock()
+	if !ok {
+		requested = calLpath
+	}
+	if aliased {
+		lpath = alias
+	} else {
+		lpath = calLpath
+		if ok {
+			// CheckLpath changed the lpath without knowing which book it was for, so
+			// start again from the lpath Calibre asked for
+			lpath = k.SanitizeLpath(requested)
+		}
+		// The lpath template only applies to new books. Existing books stay where they are.
+		if !k.HasMetadata(util.LpathToContentID(lpath, string(k.ContentIDprefix))) {
+			lpath = k.TemplateLpath(lpath, md)
+		}
+		lpath, err = k.uniqueLpath(lpath, func(emd uc.CalibreBookMeta, info bookInfo) bool {
+			if md.UUID != "" && emd.UUID != "" {
+				return emd.UUID == md.UUID
+			}
+			return emd.Lpath == lpath
+		})
+		if err != nil {
+			return "", "", fmt.Errorf("BookLpath: %w", err)
+		}
+		if lpath != calLpath {
+			kulog.Infof("Saving '%s' to '%s' instead", calLpath, lpath)
+			k.SetLpathAlias(calLpath, lpath)
+		}
+	}
+	if requested == lpath {
+		requested = ""
+	}
+	return lpath, requested, nil
+}
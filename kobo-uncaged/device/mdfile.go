@@ -0,0 +1,228 @@
+// Copyright 2019-2020 Sherman Perry
+
+// This file is part of Kobo UNCaGED.
+
+// Kobo UNCaGED is free software: you can redistribute it and/or modify
+// it under the terms of the Affero GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Kobo UNCaGED is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with Kobo UNCaGED.  If not, see <https://www.gnu.org/licenses/>.
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/kulog"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// mdEntry is an entry in a metadata.calibre file. Other drivers (such as Calibre's KoboTouch
+// driver over USB) may store fields KU doesn't know about. These are kept in extra, so they
+// can be written back unchanged.
+type mdEntry struct {
+	md    uc.CalibreBookMeta
+	extra map[string]json.RawMessage
+}
+
+// mdWriteDelay is how long KU waits for further changes before writing metadata.calibre
+const mdWriteDelay = 3 * time.Second
+
+// knownMDfields are the JSON fields of uc.CalibreBookMeta
+var knownMDfields = func() map[string]bool {
+	b, _ := json.Marshal(uc.CalibreBookMeta{})
+	var fields map[string]json.RawMessage
+	json.Unmarshal(b, &fields)
+	known := make(map[string]bool, len(fields))
+	for name := range fields {
+		known[name] = true
+	}
+	return known
+}()
+
+// decodeMDentry decodes a single metadata.calibre entry
+func decodeMDentry(raw json.RawMessage) (mdEntry, error) {
+	var e mdEntry
+	if err := json.Unmarshal(raw, &e.md); err != nil {
+		return e, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return e, err
+	}
+	for name, val := range fields {
+		if knownMDfields[name] {
+			continue
+		}
+		if e.extra == nil {
+			e.extra = make(map[string]json.RawMessage)
+		}
+		e.extra[name] = val
+	}
+	return e, nil
+}
+
+// encode returns the JSON for the entry, including any extra fields
+func (e mdEntry) encode() ([]byte, error) {
+	b, err := json.Marshal(e.md)
+	if err != nil || len(e.extra) == 0 {
+		return b, err
+	}
+	names := make([]string, 0, len(e.extra))
+	for name := range e.extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// Append the extra fields to the encoded object
+	var buf bytes.Buffer
+	buf.Write(b[:len(b)-1])
+	for _, name := range names {
+		key, _ := json.Marshal(name)
+		buf.WriteByte(',')
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(e.extra[name])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// readMDentries decodes the entries of a metadata.calibre file one at a time, passing each
+// to fn, so the whole file is never held in memory. A missing or empty file has no entries.
+func readMDentries(fn string, each func(e mdEntry) error) error {
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("readMDentries: %w", err)
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	tok, err := dec.Token()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("readMDentries: %w", err)
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '[' {
+		return fmt.Errorf("readMDentries: expected a JSON array")
+	}
+	for dec.More() {
+		var raw json.RawMessage
+		if err = dec.Decode(&raw); err != nil {
+			return fmt.Errorf("readMDentries: %w", err)
+		}
+		e, err := decodeMDentry(raw)
+		if err != nil {
+			return fmt.Errorf("readMDentries: error decoding entry: %w", err)
+		}
+		if err = each(e); err != nil {
+			return err
+		}
+	}
+	if _, err = dec.Token(); err != nil {
+		return fmt.Errorf("readMDentries: %w", err)
+	}
+	return nil
+}
+
+// writeMDentries writes a metadata.calibre file, encoding each entry passed to write as it
+// goes. The file is written to a temporary file first, which replaces the old file once it
+// is complete, so an interrupted write can't leave a truncated file behind.
+func writeMDentries(fn string, entries func(write func(e mdEntry) error) error) (err error) {
+	tmp := fn + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("writeMDentries: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+	w := bufio.NewWriter(f)
+	var buf bytes.Buffer
+	n := 0
+	err = entries(func(e mdEntry) error {
+		b, err := e.encode()
+		if err != nil {
+			return fmt.Errorf("error encoding entry: %w", err)
+		}
+		if n == 0 {
+			w.WriteString("[\n    ")
+		} else {
+			w.WriteString(",\n    ")
+		}
+		n++
+		buf.Reset()
+		if err = json.Indent(&buf, b, "    ", "    "); err != nil {
+			return err
+		}
+		_, err = buf.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("writeMDentries: %w", err)
+	}
+	if n == 0 {
+		w.WriteString("[]\n")
+	} else {
+		w.WriteString("\n]\n")
+	}
+	if err = w.Flush(); err != nil {
+		return fmt.Errorf("writeMDentries: %w", err)
+	}
+	if err = f.Sync(); err != nil {
+		return fmt.Errorf("writeMDentries: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("writeMDentries: %w", err)
+	}
+	if err = os.Rename(tmp, fn); err != nil {
+		return fmt.Errorf("writeMDentries: %w", err)
+	}
+	return nil
+}
+
+// ScheduleMDwrite writes metadata.calibre after a short delay, so that several changes
+// made in quick succession, such as a batch of books being deleted, are written together.
+func (k *Kobo) ScheduleMDwrite() {
+	k.mdTimerMux.Lock()
+	defer k.mdTimerMux.Unlock()
+	if k.mdWriteTimer != nil {
+		// A write is already pending, and will include this change
+		return
+	}
+	k.mdWriteTimer = time.AfterFunc(mdWriteDelay, func() {
+		k.mdTimerMux.Lock()
+		k.mdWriteTimer = nil
+		k.mdTimerMux.Unlock()
+		if err := k.WriteMDfile(); err != nil {
+			kulog.Err(err)
+		}
+	})
+}
+
+// cancelMDwrite cancels a pending write, as the metadata is about to be written anyway
+func (k *Kobo) cancelMDwrite() {
+	k.mdTimerMux.Lock()
+	defer k.mdTimerMux.Unlock()
+	if k.mdWriteTimer != nil && k.mdWriteTimer.Stop() {
+		k.mdWriteTimer = nil
+	}
+}
@@ -0,0 +1,436 @@
+// Copyright 2019-2020 Sherman Perry
+
+// This file is part of Kobo UNCaGED.
+
+// Kobo UNCaGED is free software: you can redistribute it and/or modify
+// it under the terms of the Affero GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Kobo UNCaGED is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with Kobo UNCaGED.  If not, see <https://www.gnu.org/licenses/>.
+
+package device
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/kulog"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+const kuMetadataDB = ".adds/kobo-uncaged/metadata.sqlite"
+
+// Metadata backends
+const (
+	// mdBackendJSON keeps book metadata in memory, and in metadata.calibre
+	mdBackendJSON = "json"
+	// mdBackendSQLite keeps book metadata in an SQLite database, which is only queried as
+	// required. metadata.calibre is still written, for Calibre's USB driver.
+	mdBackendSQLite = "sqlite"
+)
+
+// validMDbackend reports whether backend is a known metadata backend
+func validMDbackend(backend string) bool {
+	return backend == mdBackendJSON || backend == mdBackendSQLite
+}
+
+// mdStore holds the metadata of the books KU manages, keyed by ContentID, as well as
+// metadata.calibre entries for books KU doesn't manage. The caller is responsible for
+// locking.
+type mdStore interface {
+	get(cid string) (mdEntry, bool, error)
+	put(cid string, e mdEntry) error
+	remove(cid string) error
+	count() (int, error)
+	// each calls fn for every book, in no particular order. fn must not modify the store.
+	each(fn func(cid string, e mdEntry) error) error
+	// byLpathKey returns the books whose lpathKey matches key
+	byLpathKey(key string) (map[string]mdEntry, error)
+	// replaceAll replaces every book with the entries passed to add
+	replaceAll(entries func(add func(cid string, e mdEntry) error) error) error
+	unmanaged() ([]mdEntry, error)
+	setUnmanaged(entries []mdEntry) error
+	// stamp identifies the version of metadata.calibre the store was last synced with
+	stamp() (string, error)
+	setStamp(s string) error
+	close() error
+}
+
+// mdFileStamp identifies the current version of the metadata.calibre file fn. It is empty
+// if the file doesn't exist.
+func mdFileStamp(fn string) string {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", fi.ModTime().UnixNano(), fi.Size())
+}
+
+// memStore is the mdStore for the JSON backend
+type memStore struct {
+	books   map[string]mdEntry
+	others  []mdEntry
+	mdStamp string
+}
+
+func newMemStore() *memStore {
+	return &memStore{books: make(map[string]mdEntry)}
+}
+
+func (s *memStore) get(cid string) (mdEntry, bool, error) {
+	e, ok := s.books[cid]
+	return e, ok, nil
+}
+
+func (s *memStore) put(cid string, e mdEntry) error {
+	s.books[cid] = e
+	return nil
+}
+
+func (s *memStore) remove(cid string) error {
+	delete(s.books, cid)
+	return nil
+}
+
+func (s *memStore) count() (int, error) {
+	return len(s.books), nil
+}
+
+func (s *memStore) each(fn func(cid string, e mdEntry) error) error {
+	for cid, e := range s.books {
+		if err := fn(cid, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memStore) byLpathKey(key string) (map[string]mdEntry, error) {
+	found := make(map[string]mdEntry)
+	for cid, e := range s.books {
+		if lpathKey(e.md.Lpath) == key {
+			found[cid] = e
+		}
+	}
+	return found, nil
+}
+
+func (s *memStore) replaceAll(entries func(add func(cid string, e mdEntry) error) error) error {
+	books := make(map[string]mdEntry)
+	err := entries(func(cid string, e mdEntry) error {
+		books[cid] = e
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.books = books
+	return nil
+}
+
+func (s *memStore) unmanaged() ([]mdEntry, error) { return s.others, nil }
+
+func (s *memStore) setUnmanaged(entries []mdEntry) error {
+	s.others = entries
+	return nil
+}
+
+func (s *memStore) stamp() (string, error) { return s.mdStamp, nil }
+
+func (s *memStore) setStamp(stamp string) error {
+	s.mdStamp = stamp
+	return nil
+}
+
+func (s *memStore) close() error { return nil }
+
+// sqliteStore is the mdStore for the SQLite backend. One database holds the metadata for
+// both internal storage and the SD card, so every query is limited to the ContentID prefix
+// of the storage in use.
+type sqliteStore struct {
+	db     *sql.DB
+	prefix string
+}
+
+const sqliteStoreSchema = `
+CREATE TABLE IF NOT EXISTS books (
+	cid TEXT PRIMARY KEY,
+	lpath TEXT NOT NULL,
+	lpath_key TEXT NOT NULL,
+	uuid TEXT NOT NULL,
+	entry TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS books_lpath ON books (lpath);
+CREATE INDEX IF NOT EXISTS books_lpath_key ON books (lpath_key);
+CREATE INDEX IF NOT EXISTS books_uuid ON books (uuid);
+CREATE TABLE IF NOT EXISTS unmanaged (
+	prefix TEXT NOT NULL,
+	lpath TEXT NOT NULL,
+	entry TEXT NOT NULL,
+	PRIMARY KEY (prefix, lpath)
+);
+CREATE TABLE IF NOT EXISTS info (
+	key TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);`
+
+// openSQLiteStore opens (or creates) the metadata database fn, for the storage with the
+// ContentID prefix
+func openSQLiteStore(fn, prefix string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", "file:"+fn+"?_timeout=5000&_journal=WAL&_sync=NORMAL")
+	if err != nil {
+		return nil, fmt.Errorf("openSQLiteStore: %w", err)
+	}
+	if _, err = db.Exec(sqliteStoreSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("openSQLiteStore: error creating tables: %w", err)
+	}
+	return &sqliteStore{db: db, prefix: prefix}, nil
+}
+
+// putEntry inserts or replaces a book, using ex, which may be a transaction
+func (s *sqliteStore) putEntry(ex interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}, cid string, e mdEntry) error {
+	b, err := e.encode()
+	if err != nil {
+		return err
+	}
+	_, err = ex.Exec(`INSERT OR REPLACE INTO books (cid, lpath, lpath_key, uuid, entry) VALUES (?, ?, ?, ?, ?)`,
+		cid, e.md.Lpath, lpathKey(e.md.Lpath), e.md.UUID, string(b))
+	return err
+}
+
+func (s *sqliteStore) get(cid string) (mdEntry, bool, error) {
+	var entry string
+	err := s.db.QueryRow(`SELECT entry FROM books WHERE cid = ?`, cid).Scan(&entry)
+	if err == sql.ErrNoRows {
+		return mdEntry{}, false, nil
+	} else if err != nil {
+		return mdEntry{}, false, fmt.Errorf("sqliteStore get: %w", err)
+	}
+	e, err := decodeMDentry([]byte(entry))
+	if err != nil {
+		return mdEntry{}, false, fmt.Errorf("sqliteStore get: %w", err)
+	}
+	return e, true, nil
+}
+
+func (s *sqliteStore) put(cid string, e mdEntry) error {
+	if err := s.putEntry(s.db, cid, e); err != nil {
+		return fmt.Errorf("sqliteStore put: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) remove(cid string) error {
+	if _, err := s.db.Exec(`DELETE FROM books WHERE cid = ?`, cid); err != nil {
+		return fmt.Errorf("sqliteStore remove: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) count() (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT count(*) FROM books WHERE substr(cid, 1, ?) = ?`, len(s.prefix), s.prefix).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("sqliteStore count: %w", err)
+	}
+	return n, nil
+}
+
+// query calls fn for each book returned by the query q
+func (s *sqliteStore) query(fn func(cid string, e mdEntry) error, q string, args ...interface{}) error {
+	rows, err := s.db.Query(q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, entry string
+		if err = rows.Scan(&cid, &entry); err != nil {
+			return err
+		}
+		e, err := decodeMDentry([]byte(entry))
+		if err != nil {
+			return err
+		}
+		if err = fn(cid, e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqliteStore) each(fn func(cid string, e mdEntry) error) error {
+	err := s.query(fn, `SELECT cid, entry FROM books WHERE substr(cid, 1, ?) = ?`, len(s.prefix), s.prefix)
+	if err != nil {
+		return fmt.Errorf("sqliteStore each: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) byLpathKey(key string) (map[string]mdEntry, error) {
+	found := make(map[string]mdEntry)
+	err := s.query(func(cid string, e mdEntry) error {
+		found[cid] = e
+		return nil
+	}, `SELECT cid, entry FROM books WHERE lpath_key = ? AND substr(cid, 1, ?) = ?`, key, len(s.prefix), s.prefix)
+	if err != nil {
+		return nil, fmt.Errorf("sqliteStore byLpathKey: %w", err)
+	}
+	return found, nil
+}
+
+func (s *sqliteStore) replaceAll(entries func(add func(cid string, e mdEntry) error) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("sqliteStore replaceAll: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(`DELETE FROM books WHERE substr(cid, 1, ?) = ?`, len(s.prefix), s.prefix); err != nil {
+		return fmt.Errorf("sqliteStore replaceAll: %w", err)
+	}
+	err = entries(func(cid string, e mdEntry) error {
+		return s.putEntry(tx, cid, e)
+	})
+	if err != nil {
+		return fmt.Errorf("sqliteStore replaceAll: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("sqliteStore replaceAll: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) unmanaged() ([]mdEntry, error) {
+	var entries []mdEntry
+	err := s.query(func(_ string, e mdEntry) error {
+		entries = append(entries, e)
+		return nil
+	}, `SELECT lpath, entry FROM unmanaged WHERE prefix = ?`, s.prefix)
+	if err != nil {
+		return nil, fmt.Errorf("sqliteStore unmanaged: %w", err)
+	}
+	return entries, nil
+}
+
+func (s *sqliteStore) setUnmanaged(entries []mdEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("sqliteStore setUnmanaged: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(`DELETE FROM unmanaged WHERE prefix = ?`, s.prefix); err != nil {
+		return fmt.Errorf("sqliteStore setUnmanaged: %w", err)
+	}
+	for _, e := range entries {
+		b, err := e.encode()
+		if err != nil {
+			return fmt.Errorf("sqliteStore setUnmanaged: %w", err)
+		}
+		if _, err = tx.Exec(`INSERT OR REPLACE INTO unmanaged (prefix, lpath, entry) VALUES (?, ?, ?)`, s.prefix, e.md.Lpath, string(b)); err != nil {
+			return fmt.Errorf("sqliteStore setUnmanaged: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("sqliteStore setUnmanaged: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) stamp() (string, error) {
+	var stamp string
+	err := s.db.QueryRow(`SELECT value FROM info WHERE key = ?`, "mdStamp:"+s.prefix).Scan(&stamp)
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("sqliteStore stamp: %w", err)
+	}
+	return stamp, nil
+}
+
+func (s *sqliteStore) setStamp(stamp string) error {
+	if _, err := s.db.Exec(`INSERT OR REPLACE INTO info (key, value) VALUES (?, ?)`, "mdStamp:"+s.prefix, stamp); err != nil {
+		return fmt.Errorf("sqliteStore setStamp: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) close() error {
+	return s.db.Close()
+}
+
+// closeMDstore writes any pending changes to metadata.calibre, and closes the metadata
+// store. The metadata is loaded again, with the configured backend, when next required.
+func (k *Kobo) closeMDstore() error {
+	if err := k.WriteMDfile(); err != nil {
+		return fmt.Errorf("closeMDstore: %w", err)
+	}
+	k.mdMux.Lock()
+	defer k.mdMux.Unlock()
+	if k.md == nil {
+		return nil
+	}
+	err := k.md.close()
+	k.md = nil
+	if err != nil {
+		return fmt.Errorf("closeMDstore: %w", err)
+	}
+	return nil
+}
+
+// GetMetadata returns the metadata of a book
+func (k *Kobo) GetMetadata(cid string) (uc.CalibreBookMeta, bool) {
+	k.mdMux.RLock()
+	defer k.mdMux.RUnlock()
+	e, ok := k.getMDentry(cid)
+	return e.md, ok
+}
+
+// getMDentry returns the metadata.calibre entry of a book. mdMux must be locked.
+func (k *Kobo) getMDentry(cid string) (mdEntry, bool) {
+	if k.md == nil {
+		return mdEntry{}, false
+	}
+	e, ok, err := k.md.get(cid)
+	if err != nil {
+		kulog.Err(err)
+		return mdEntry{}, false
+	}
+	return e, ok
+}
+
+// EachMetadata calls fn with the metadata of every book. The metadata can't be modified
+// until fn returns.
+func (k *Kobo) EachMetadata(fn func(cid string, md uc.CalibreBookMeta)) error {
+	k.mdMux.RLock()
+	defer k.mdMux.RUnlock()
+	if k.md == nil {
+		return nil
+	}
+	return k.md.each(func(cid string, e mdEntry) error {
+		fn(cid, e.md)
+		return nil
+	})
+}
+
+// MetadataCount returns the number of books KU manages
+func (k *Kobo) MetadataCount() int {
+	k.mdMux.RLock()
+	defer k.mdMux.RUnlock()
+	if k.md == nil {
+		return 0
+	}
+	n, err := k.md.count()
+	if err != nil {
+		kulog.Err(err)
+	}
+	return n
+}
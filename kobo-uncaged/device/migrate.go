@@ -0,0 +1,573 @@
+// Copyright 2019-2020 Sherman Perry
+
+// This file is part of Kobo UNCaGED.
+
+// Kobo UNCaGED is free software: you can redistribute it and/or modify
+// it under the terms of the Affero GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Kobo UNCaGED is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with Kobo UNCaGED.  If not, see <https://www.gnu.org/licenses/>.
+
+package device
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pgaskin/koboutils/v2/kobo"
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/kulog"
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// kuMigrateSQL is applied to the Nickel database by nm-start-ku.sh, whatever KU's exit code
+const kuMigrateSQL = ".adds/kobo-uncaged/migrate.sql"
+
+// Storage names used by the web UI
+const (
+	storageOnboard = "onboard"
+	storageSD      = "sd"
+)
+
+// ErrMigrationPending is returned if Calibre is connected to after books have been moved,
+// as the Nickel database isn't updated until KU exits
+var ErrMigrationPending = errors.New("books have been moved between storages, KU must exit first")
+
+// ErrSessionStarted is returned if books are moved after the Calibre session has started, as
+// Calibre may be sending or deleting them
+var ErrSessionStarted = errors.New("the Calibre session has started, books can't be moved")
+
+// migrateColumns are the columns in the Nickel database that refer to a book by its ContentID.
+// If parts is set, the column may also refer to part of the book, such as a chapter, with
+// an ID made of the book ContentID followed by '!' or '#'.
+var migrateColumns = []struct {
+	table, column string
+	parts         bool
+}{
+	{"content", "ContentID", true},
+	{"content", "BookID", false},
+	{"Bookmark", "ContentID", true},
+	{"Bookmark", "VolumeID", false},
+	{"ShelfContent", "ContentId", false},
+	{"volume_shortcovers", "volumeId", false},
+	{"volume_shortcovers", "shortcoverId", true},
+	{"volume_tabs", "volumeid", false},
+	{"volume_tabs", "tabId", true},
+	{"content_settings", "ContentID", false},
+	{"ratings", "ContentID", false},
+	{"Event", "ContentID", false},
+}
+
+// migrateCovers are the cover images Nickel may have generated for a book
+var migrateCovers = []kobo.CoverType{kobo.CoverTypeFull, kobo.CoverTypeLibFull, kobo.CoverTypeLibGrid, kobo.CoverTypeLibList}
+
+// bookStorage is one of the places sideloaded books can be stored
+type bookStorage struct {
+	name     string
+	root     string
+	prefix   cidPrefix
+	external bool
+}
+
+// storageBook is a book listed on the storage page of the web UI
+type storageBook struct {
+	ContentID string   `json:"contentID"`
+	Title     string   `json:"title"`
+	Authors   []string `json:"authors"`
+	Size      int      `json:"size"`
+}
+
+// storageInfo lists the books on each storage
+type storageInfo struct {
+	Current string        `json:"current"`
+	HasSD   bool          `json:"hasSD"`
+	Pending bool          `json:"pending"`
+	Onboard []storageBook `json:"onboard"`
+	SD      []storageBook `json:"sd"`
+}
+
+// migrateResult is the outcome of moving books between storages
+type migrateResult struct {
+	Moved  int            `json:"moved"`
+	Errors []SessionError `json:"errors"`
+}
+
+func (k *Kobo) storage(name string) (bookStorage, error) {
+	switch name {
+	case storageOnboard:
+		return bookStorage{name: name, root: k.DBRootDir, prefix: onboardPrefix}, nil
+	case storageSD:
+		if k.SDRootDir == "" {
+			return bookStorage{}, fmt.Errorf("storage: no SD card found")
+		}
+		return bookStorage{name: name, root: k.SDRootDir, prefix: sdPrefix, external: true}, nil
+	}
+	return bookStorage{}, fmt.Errorf("storage: unknown storage '%s'", name)
+}
+
+func (k *Kobo) currentStorage() string {
+	if k.UseSDCard {
+		return storageSD
+	}
+	return storageOnboard
+}
+
+// MigrationPending reports whether books have been moved between storages this session
+func (k *Kobo) MigrationPending() bool {
+	k.mdMux.RLock()
+	defer k.mdMux.RUnlock()
+	return k.migrationPending
+}
+
+// startSession records that the user has started the Calibre session. Books can't be moved
+// between storages after this, and the session can't be started if they already have been.
+func (k *Kobo) startSession() error {
+	k.sessionMux.Lock()
+	defer k.sessionMux.Unlock()
+	if k.MigrationPending() {
+		return ErrMigrationPending
+	} else if k.sessionStarted {
+		return ErrSessionStarted
+	}
+	k.sessionStarted = true
+	return nil
+}
+
+func (k *Kobo) openNickelDB() (*sql.DB, error) {
+	dsn := "file:" + filepath.Join(k.DBRootDir, koboDBpath) + "?_timeout=2000&_journal=WAL&mode=ro&_mutex=full&_sync=NORMAL"
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("openNickelDB: sql open failed: %w", err)
+	}
+	return db, nil
+}
+
+// sideloadedBooks lists the sideloaded books Nickel knows about on a storage
+func sideloadedBooks(db *sql.DB, st bookStorage) ([]storageBook, error) {
+	rows, err := db.Query(`
+		SELECT ContentID, Title, Attribution, ___FileSize
+		FROM content
+		WHERE ContentType=6
+		AND MimeType NOT LIKE 'image%%'
+		AND (IsDownloaded='true' OR IsDownloaded=1)
+		AND ___FileSize>0
+		AND Accessibility=-1
+		AND ContentID LIKE ?;`, fmt.Sprintf("%s%%", st.prefix))
+	if err != nil {
+		return nil, fmt.Errorf("sideloadedBooks: error getting book rows: %w", err)
+	}
+	defer rows.Close()
+	books := make([]storageBook, 0)
+	for rows.Next() {
+		var title, attr *string
+		var bk storageBook
+		if err = rows.Scan(&bk.ContentID, &title, &attr, &bk.Size); err != nil {
+			return nil, fmt.Errorf("sideloadedBooks: row decoding error: %w", err)
+		}
+		if title != nil {
+			bk.Title = *title
+		}
+		if attr != nil {
+			for _, a := range strings.Split(*attr, ",") {
+				bk.Authors = append(bk.Authors, strings.TrimSpace(a))
+			}
+		}
+		books = append(books, bk)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("sideloadedBooks: %w", err)
+	}
+	return books, nil
+}
+
+// listStorage lists the sideloaded books on a storage, including books moved there this
+// session. Nickel's database still has the old ContentIDs of moved books until KU exits.
+func (k *Kobo) listStorage(db *sql.DB, st bookStorage) ([]storageBook, error) {
+	books, err := sideloadedBooks(db, st)
+	if err != nil {
+		return nil, err
+	}
+	k.mdMux.RLock()
+	defer k.mdMux.RUnlock()
+	listed := books[:0]
+	for _, bk := range books {
+		if _, moved := k.migrated[bk.ContentID]; !moved {
+			listed = append(listed, bk)
+		}
+	}
+	for _, bk := range k.migrated {
+		if strings.HasPrefix(bk.ContentID, string(st.prefix)) {
+			listed = append(listed, bk)
+		}
+	}
+	return listed, nil
+}
+
+// StorageBooks lists the sideloaded books on internal storage, and on the SD card if there is one
+func (k *Kobo) StorageBooks() (storageInfo, error) {
+	info := storageInfo{Current: k.currentStorage(), HasSD: k.SDRootDir != "", Pending: k.MigrationPending()}
+	db, err := k.openNickelDB()
+	if err != nil {
+		return info, fmt.Errorf("StorageBooks: %w", err)
+	}
+	defer db.Close()
+	onboard, _ := k.storage(storageOnboard)
+	if info.Onboard, err = k.listStorage(db, onboard); err != nil {
+		return info, fmt.Errorf("StorageBooks: %w", err)
+	}
+	info.SD = make([]storageBook, 0)
+	if sd, err := k.storage(storageSD); err == nil {
+		if info.SD, err = k.listStorage(db, sd); err != nil {
+			return info, fmt.Errorf("StorageBooks: %w", err)
+		}
+	}
+	return info, nil
+}
+
+// existingColumns returns the migrateColumns present in the Nickel database, as the schema
+// varies between firmware versions
+func existingColumns(db *sql.DB) (map[string]bool, error) {
+	cols := make(map[string]bool)
+	for _, mc := range migrateColumns {
+		key := mc.table + "." + mc.column
+		if _, checked := cols[key]; checked {
+			continue
+		}
+		var n int
+		err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ? COLLATE NOCASE;`, mc.table, mc.column).Scan(&n)
+		if err != nil {
+			return nil, fmt.Errorf("existingColumns: %w", err)
+		}
+		cols[key] = n > 0
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('content') WHERE name = 'ImageId';`).Scan(&n); err != nil {
+		return nil, fmt.Errorf("existingColumns: %w", err)
+	}
+	cols["content.ImageId"] = n > 0
+	return cols, nil
+}
+
+// migrateBookSQL returns the queries to change the ContentID of a book in the Nickel database.
+// Applying the queries a second time has no effect.
+func migrateBookSQL(cols map[string]bool, oldCID, newCID string) ([]string, error) {
+	dialect := goqu.Dialect("sqlite3")
+	// Note, SQLite lengths are in characters
+	n := utf8.RuneCountInString(oldCID)
+	partOf := func(col string, cid string) goqu.Expression {
+		return goqu.Or(
+			goqu.C(col).Eq(cid),
+			goqu.L("substr(?, 1, ?)", goqu.C(col), utf8.RuneCountInString(cid)+1).In(cid+"!", cid+"#"),
+		)
+	}
+	var queries []string
+	add := func(ds interface {
+		ToSQL() (string, []interface{}, error)
+	}) error {
+		q, _, err := ds.ToSQL()
+		if err != nil {
+			return fmt.Errorf("migrateBookSQL: %w", err)
+		}
+		queries = append(queries, q)
+		return nil
+	}
+	// Remove any stale rows left behind for the new ContentID, but only while the book
+	// still has its old ContentID
+	stillOld := goqu.L("EXISTS (SELECT 1 FROM content WHERE ContentID = ?)", oldCID)
+	if err := add(dialect.Delete("content").Where(partOf("ContentID", newCID), stillOld)); err != nil {
+		return nil, err
+	}
+	for _, mc := range migrateColumns {
+		if !cols[mc.table+"."+mc.column] {
+			continue
+		}
+		var ds interface {
+			ToSQL() (string, []interface{}, error)
+		}
+		if mc.parts {
+			ds = dialect.Update(mc.table).
+				Set(goqu.Record{mc.column: goqu.L("? || substr(?, ?)", newCID, goqu.C(mc.column), n+1)}).
+				Where(partOf(mc.column, oldCID))
+		} else {
+			ds = dialect.Update(mc.table).Set(goqu.Record{mc.column: newCID}).Where(goqu.C(mc.column).Eq(oldCID))
+		}
+		if err := add(ds); err != nil {
+			return nil, err
+		}
+	}
+	if cols["content.ImageId"] {
+		ds := dialect.Update("content").
+			Set(goqu.Record{"ImageId": kobo.ContentIDToImageID(newCID)}).
+			Where(goqu.Ex{"ContentID": newCID, "ContentType": 6})
+		if err := add(ds); err != nil {
+			return nil, err
+		}
+	}
+	return queries, nil
+}
+
+// moveFile moves src to dst, copying it if they are on different filesystems. The copy is
+// only put in place once complete, so dst never contains a partial file.
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	part := PartPath(dst)
+	out, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(part, dst)
+	}
+	if err != nil {
+		os.Remove(part)
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
+
+// MigrateBooks moves sideloaded books to the storage named to. If cids is empty, all
+// sideloaded books on the other storage are moved. Book files and covers are moved
+// straight away, along with their metadata.calibre entries. The Nickel database is
+// updated with the new ContentIDs, keeping reading state, bookmarks and collections,
+// once KU exits. Until then, KU can't connect to Calibre.
+func (k *Kobo) MigrateBooks(to string, cids []string) (migrateResult, error) {
+	res := migrateResult{Errors: make([]SessionError, 0)}
+	// Held until the books are moved, so the session can't start part way through
+	k.sessionMux.Lock()
+	defer k.sessionMux.Unlock()
+	if k.sessionStarted {
+		return res, fmt.Errorf("MigrateBooks: %w", ErrSessionStarted)
+	}
+	from := storageOnboard
+	if to == storageOnboard {
+		from = storageSD
+	}
+	src, err := k.storage(from)
+	if err != nil {
+		return res, fmt.Errorf("MigrateBooks: %w", err)
+	}
+	dst, err := k.storage(to)
+	if err != nil {
+		return res, fmt.Errorf("MigrateBooks: %w", err)
+	}
+	// The metadata for the current storage is kept in memory, and may be written at any time
+	if err = k.loadMetadata(); err != nil {
+		return res, fmt.Errorf("MigrateBooks: %w", err)
+	}
+	db, err := k.openNickelDB()
+	if err != nil {
+		return res, fmt.Errorf("MigrateBooks: %w", err)
+	}
+	defer db.Close()
+	books, err := k.listStorage(db, src)
+	if err != nil {
+		return res, fmt.Errorf("MigrateBooks: %w", err)
+	}
+	if len(cids) > 0 {
+		wanted := make(map[string]bool, len(cids))
+		for _, cid := range cids {
+			wanted[cid] = true
+		}
+		selected := books[:0]
+		for _, bk := range books {
+			if wanted[bk.ContentID] {
+				selected = append(selected, bk)
+			}
+		}
+		books = selected
+	}
+	if len(books) == 0 {
+		return res, nil
+	}
+	cols, err := existingColumns(db)
+	if err != nil {
+		return res, fmt.Errorf("MigrateBooks: %w", err)
+	}
+	// Only one of the storages has its metadata in memory
+	current := src
+	other := dst
+	if to == k.currentStorage() {
+		current, other = dst, src
+	}
+	var otherMD []mdEntry
+	err = readMDentries(filepath.Join(other.root, calibreMDfile), func(e mdEntry) error {
+		otherMD = append(otherMD, e)
+		return nil
+	})
+	if err != nil {
+		return res, fmt.Errorf("MigrateBooks: %w", err)
+	}
+	sqlFile, err := os.OpenFile(filepath.Join(k.DBRootDir, kuMigrateSQL), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return res, fmt.Errorf("MigrateBooks: error opening migration SQL file: %w", err)
+	}
+	migrateSQL := &sqlWriter{sqlFile: sqlFile, sqlBuffWriter: bufio.NewWriter(sqlFile)}
+	defer migrateSQL.close()
+
+	for i, bk := range books {
+		lpath := util.ContentIDtoLpath(bk.ContentID, string(src.prefix))
+		newCID := util.LpathToContentID(lpath, string(dst.prefix))
+		srcPath := filepath.Join(src.root, lpath)
+		dstPath := filepath.Join(dst.root, lpath)
+		k.WebSend(WebMsg{ShowMessage: fmt.Sprintf("Moving: %s", bk.Title), Progress: (i * 100) / len(books)})
+		fail := func(err error) {
+			kulog.Warnf("MigrateBooks: %v", err)
+			res.Errors = append(res.Errors, SessionError{Item: lpath, Error: err.Error()})
+		}
+		if _, err := os.Stat(dstPath); err == nil {
+			fail(fmt.Errorf("a file already exists at the destination"))
+			continue
+		}
+		if free, err := freeSpaceAt(dst.root); err == nil && free < uint64(bk.Size)+k.ReservedSpace() {
+			fail(ErrInsufficientSpace)
+			continue
+		}
+		queries, err := migrateBookSQL(cols, bk.ContentID, newCID)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		if err = moveFile(srcPath, dstPath); err != nil {
+			fail(fmt.Errorf("error moving book: %w", err))
+			continue
+		}
+		removeEmptyDirs(filepath.Dir(srcPath), src.root)
+		// Nickel can regenerate missing covers, so failing to move them isn't an error
+		oldIID, newIID := kobo.ContentIDToImageID(bk.ContentID), kobo.ContentIDToImageID(newCID)
+		for _, ct := range migrateCovers {
+			oldCover := filepath.Join(src.root, ct.GeneratePath(src.external, oldIID))
+			if err := moveFile(oldCover, filepath.Join(dst.root, ct.GeneratePath(dst.external, newIID))); err != nil && !os.IsNotExist(err) {
+				kulog.Warnf("MigrateBooks: error moving cover: %v", err)
+			}
+		}
+		// The book has moved, so the ContentID must be changed, even if KU is interrupted
+		migrateSQL.writeBegin()
+		for _, q := range queries {
+			migrateSQL.writeQuery(q)
+		}
+		migrateSQL.writeCommit()
+		if err = migrateSQL.sync(); err != nil {
+			return res, fmt.Errorf("MigrateBooks: error writing migration SQL: %w", err)
+		}
+		k.migrateMetadata(bk, lpath, newCID, current, &otherMD)
+		res.Moved++
+	}
+	k.mdMux.Lock()
+	k.migrationPending = res.Moved > 0 || k.migrationPending
+	err = k.saveDeleteQueue()
+	k.mdMux.Unlock()
+	if err != nil {
+		kulog.Err(err)
+	}
+	err = writeMDentries(filepath.Join(other.root, calibreMDfile), func(write func(mdEntry) error) error {
+		for _, e := range otherMD {
+			if err := write(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return res, fmt.Errorf("MigrateBooks: error writing metadata: %w", err)
+	}
+	if err = k.WriteMDfile(); err != nil {
+		return res, fmt.Errorf("MigrateBooks: %w", err)
+	}
+	return res, nil
+}
+
+// migrateMetadata moves the metadata, book info and deletion mark of a moved book to its new
+// ContentID. current is the storage whose metadata is in the metadata store, the metadata of the
+// other storage is in otherMD.
+func (k *Kobo) migrateMetadata(bk storageBook, lpath, newCID string, current bookStorage, otherMD *[]mdEntry) {
+	k.mdMux.Lock()
+	defer k.mdMux.Unlock()
+	// Nickel's database is updated with the new ContentID when KU exits. Keep track of the
+	// ContentID the database knows, in case the book is moved back again.
+	dbCID := bk.ContentID
+	for old, moved := range k.migrated {
+		if moved.ContentID == bk.ContentID {
+			dbCID = old
+			break
+		}
+	}
+	delete(k.migrated, dbCID)
+	if dbCID != newCID {
+		movedBk := bk
+		movedBk.ContentID = newCID
+		k.migrated[dbCID] = movedBk
+	}
+	found := false
+	if strings.HasPrefix(bk.ContentID, string(current.prefix)) {
+		// Moving from the current storage
+		var e mdEntry
+		if e, found = k.getMDentry(bk.ContentID); found {
+			if err := k.md.remove(bk.ContentID); err != nil {
+				kulog.Err(err)
+			}
+			*otherMD = append(*otherMD, e)
+		}
+		delete(k.BooksInDB, bk.ContentID)
+	} else {
+		// Moving to the current storage
+		var e mdEntry
+		for i, oe := range *otherMD {
+			if util.LpathKepubConvert(oe.md.Lpath) == lpath {
+				e, found = oe, true
+				*otherMD = append((*otherMD)[:i], (*otherMD)[i+1:]...)
+				break
+			}
+		}
+		if !found {
+			e.md = uc.CalibreBookMeta{Lpath: lpath, Title: bk.Title, Authors: bk.Authors, Size: bk.Size}
+		}
+		if err := k.md.put(newCID, e); err != nil {
+			kulog.Err(err)
+		}
+		if k.BooksInDB != nil {
+			k.BooksInDB[newCID] = struct{}{}
+		}
+	}
+	k.mdDirty = true
+	if info, ok := k.bookInfo[bk.ContentID]; ok {
+		k.bookInfo[newCID] = info
+		delete(k.bookInfo, bk.ContentID)
+	}
+	if mark, ok := k.deleteQueue[bk.ContentID]; ok {
+		k.deleteQueue[newCID] = mark
+		delete(k.deleteQueue, bk.ContentID)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2019-2020 Sherman Perry
+
+// This file is part of Kobo UNCaGED.
+
+// Kobo UNCaGED is free software: you can redistribute it and/or modify
+// it under the terms of the Affero GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Kobo UNCaGED is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with Kobo UNCaGED.  If not, see <https://www.gnu.org/licenses/>.
+
+package device
+
+import (
+	"strings"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// nickelFieldOptions selects the Calibre fields, in addition to the description, series
+// and subtitle, that are written to the Nickel database
+type nickelFieldOptions struct {
+	Title     bool `json:"title"`
+	Authors   bool `json:"authors"`
+	Publisher bool `json:"publisher"`
+	PubDate   bool `json:"pubDate"`
+	Language  bool `json:"language"`
+	ISBN      bool `json:"isbn"`
+	Rating    bool `json:"rating"`
+}
+
+// nickelTimeFormat is the format of timestamps in the Nickel database
+const nickelTimeFormat = "2006-01-02T15:04:05Z"
+
+// iso639Languages maps the ISO 639-2 language codes Calibre uses to the ISO 639-1 codes
+// Nickel uses, for the more common languages
+var iso639Languages = map[string]string{
+	"ara": "ar", "cat": "ca", "ces": "cs", "chi": "zh", "cze": "cs", "dan": "da", "deu": "de",
+	"dut": "nl", "ell": "el", "eng": "en", "est": "et", "fin": "fi", "fra": "fr", "fre": "fr",
+	"ger": "de", "gre": "el", "heb": "he", "hin": "hi", "hrv": "hr", "hun": "hu", "ind": "id",
+	"isl": "is", "ita": "it", "jpn": "ja", "kor": "ko", "lat": "la", "lav": "lv", "lit": "lt",
+	"msa": "ms", "nld": "nl", "nob": "nb", "nor": "no", "pol": "pl", "por": "pt", "ron": "ro",
+	"rum": "ro", "rus": "ru", "slk": "sk", "slo": "sk", "slv": "sl", "spa": "es", "srp": "sr",
+	"swe": "sv", "tha": "th", "tur": "tr", "ukr": "uk", "vie": "vi", "zho": "zh",
+}
+
+// nickelLanguage converts a Calibre language code to the form Nickel uses
+func nickelLanguage(lang string) string {
+	lang = strings.ToLower(lang)
+	if l, ok := iso639Languages[lang]; ok {
+		return l
+	}
+	return lang
+}
+
+// optString returns a pointer to s, or nil if s is empty, so empty fields are set to NULL
+func optString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// addNickelFields adds the optional Calibre fields selected in opts to a content table record.
+// Title and authors are only set if Calibre has them, as Nickel requires a title.
+func addNickelFields(rec goqu.Record, md *uc.CalibreBookMeta, opts nickelFieldOptions) {
+	if opts.Title && md.Title != "" {
+		rec["Title"] = md.Title
+	}
+	if opts.Authors && len(md.Authors) > 0 {
+		rec["Attribution"] = strings.Join(md.Authors, ", ")
+	}
+	if opts.Publisher {
+		rec["Publisher"] = optString(md.PubString())
+	}
+	if opts.PubDate {
+		var pubdate *string
+		if t := md.Pubdate.GetTime(); t != nil {
+			pubdate = optString(t.UTC().Format(nickelTimeFormat))
+		}
+		rec["DateCreated"] = pubdate
+	}
+	if opts.Language {
+		var lang *string
+		if len(md.Languages) > 0 {
+			lang = optString(nickelLanguage(md.Languages[0]))
+		}
+		rec["Language"] = lang
+	}
+	if opts.ISBN {
+		rec["ISBN"] = optString(md.Identifiers["isbn"])
+	}
+}
+
+// nickelRatingSQL returns the query setting the rating of a book, or an empty string if the
+// book isn't rated in Calibre, so a rating set on the Kobo is kept. Nickel keeps ratings, out
+// of 5 stars, in their own table, while Calibre's ratings are out of 10.
+func nickelRatingSQL(dialect goqu.DialectWrapper, cid string, md *uc.CalibreBookMeta, now time.Time) (string, error) {
+	if md.Rating == nil || *md.Rating <= 0 {
+		return "", nil
+	}
+	rating := int(*md.Rating/2 + 0.5)
+	if rating > 5 {
+		rating = 5
+	}
+	modified := now.UTC().Format(nickelTimeFormat)
+	sqlStr, _, err := dialect.Insert("ratings").
+		Rows(goqu.Record{"ContentID": cid, "Rating": rating, "DateModified": modified}).
+		OnConflict(goqu.DoUpdate("ContentID", goqu.Record{"Rating": rating, "DateModified": modified})).
+		ToSQL()
+	return sqlStr, err
+}
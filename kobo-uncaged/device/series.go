@@ -0,0 +1,103 @@
+// Copyright 2019-2020 Sherman Perry
+
+// This file is part of Kobo UNCaGED.
+
+// Kobo UNCaGED is free software: you can redistribute it and/or modify
+// it under the terms of the Affero GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Kobo UNCaGED is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with Kobo UNCaGED.  If not, see <https://www.gnu.org/licenses/>.
+
+package device
+
+import (
+	"fmt"
+
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/kulog"
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
+)
+
+// storeSeries is a series of store bought books in the Nickel database
+type storeSeries struct {
+	Name string
+	ID   string
+}
+
+// seriesMatcher matches the series of sideloaded books to the series of store bought books,
+// so that Nickel groups them together
+type seriesMatcher struct {
+	// aliases maps normalized series names to the name the user wants to use instead
+	aliases map[string]string
+	// store maps normalized series names to store series
+	store map[string]storeSeries
+}
+
+// newSeriesMatcher creates a seriesMatcher for the series in the Nickel database, and
+// the series aliases from the config. If the database can't be read, only the aliases
+// are used.
+func (k *Kobo) newSeriesMatcher() *seriesMatcher {
+	m := &seriesMatcher{aliases: make(map[string]string), store: make(map[string]storeSeries)}
+	for from, to := range k.KuConfig.SeriesAliases {
+		m.aliases[util.NormalizeSeries(from)] = to
+	}
+	if err := m.loadStoreSeries(k); err != nil {
+		kulog.Warnf("newSeriesMatcher: store series won't be matched: %v", err)
+	}
+	return m
+}
+
+// loadStoreSeries reads the series of store bought books from the Nickel database
+func (m *seriesMatcher) loadStoreSeries(k *Kobo) error {
+	db, err := k.openNickelDB()
+	if err != nil {
+		return fmt.Errorf("loadStoreSeries: %w", err)
+	}
+	defer db.Close()
+	rows, err := db.Query(`
+		SELECT DISTINCT Series, SeriesID FROM content
+		WHERE ContentType = 6 AND ContentID NOT LIKE 'file://%'
+		AND Series IS NOT NULL AND Series <> '' AND SeriesID IS NOT NULL AND SeriesID <> ''
+		ORDER BY SeriesID;`)
+	if err != nil {
+		return fmt.Errorf("loadStoreSeries: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s storeSeries
+		if err = rows.Scan(&s.Name, &s.ID); err != nil {
+			return fmt.Errorf("loadStoreSeries: %w", err)
+		}
+		m.addStoreSeries(s)
+	}
+	return rows.Err()
+}
+
+// addStoreSeries adds a store series. If more than one store series has the same
+// normalized name, the first is used.
+func (m *seriesMatcher) addStoreSeries(s storeSeries) {
+	key := util.NormalizeSeries(s.Name)
+	if _, exists := m.store[key]; !exists {
+		m.store[key] = s
+	}
+}
+
+// match returns the series name and SeriesID to use for a sideloaded book in series.
+// If the series matches a store series, its name and ID are used. Otherwise, the
+// (possibly aliased) series name is used for both.
+func (m *seriesMatcher) match(series string) (name, id string) {
+	name = series
+	if alias, ok := m.aliases[util.NormalizeSeries(series)]; ok {
+		name = alias
+	}
+	if s, ok := m.store[util.NormalizeSeries(name)]; ok {
+		return s.Name, s.ID
+	}
+	return name, name
+}
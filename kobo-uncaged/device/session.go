@@ -0,0 +1,171 @@
+// Copyright 2019-2020 Sherman Perry
+
+// This file is part of Kobo UNCaGED.
+
+// Kobo UNCaGED is free software: you can redistribute it and/or modify
+// it under the terms of the Affero GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Kobo UNCaGED is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with Kobo UNCaGED.  If not, see <https://www.gnu.org/licenses/>.
+
+package device
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/kulog"
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
+)
+
+const kuSessionHistory = ".adds/kobo-uncaged/session-history.json"
+
+// maxSessionHistory is the number of sessions kept in the history file
+const maxSessionHistory = 20
+
+// SessionSummary is a record of what happened during a single session with Calibre
+type SessionSummary struct {
+	Start           time.Time      `json:"start"`
+	End             time.Time      `json:"end"`
+	DurationSecs    float64        `json:"durationSecs"`
+	Result          string         `json:"result"`
+	LibraryUUID     string         `json:"libraryUUID"`
+	LibraryName     string         `json:"libraryName"`
+	DeviceModel     string         `json:"deviceModel"`
+	Firmware        string         `json:"firmware"`
+	BooksReceived   int            `json:"booksReceived"`
+	BooksReplaced   int            `json:"booksReplaced"`
+	BooksDeleted    int            `json:"booksDeleted"`
+	BooksSent       int            `json:"booksSent"`
+	MetadataUpdated int            `json:"metadataUpdated"`
+	CoversGenerated int            `json:"coversGenerated"`
+	BytesReceived   int64          `json:"bytesReceived"`
+	BytesSent       int64          `json:"bytesSent"`
+	Errors          []SessionError `json:"errors"`
+}
+
+// SessionError records an error that occurred while processing a single item (usually a book)
+type SessionError struct {
+	Item  string `json:"item"`
+	Error string `json:"error"`
+}
+
+// SessionLog collects the session summary as the session progresses.
+// It is safe for concurrent use.
+type SessionLog struct {
+	mux     sync.Mutex
+	summary SessionSummary
+	onError func(SessionError)
+}
+
+// newSessionLog starts a new session log. onError, if not nil, is called for every error recorded.
+func newSessionLog(onError func(SessionError)) *SessionLog {
+	return &SessionLog{summary: SessionSummary{Start: time.Now(), Errors: make([]SessionError, 0)}, onError: onError}
+}
+
+// BookReceived records a book received from Calibre
+func (s *SessionLog) BookReceived(size int, replaced bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if replaced {
+		s.summary.BooksReplaced++
+	} else {
+		s.summary.BooksReceived++
+	}
+	s.summary.BytesReceived += int64(size)
+}
+
+// BookDeleted records a book deleted from the device
+func (s *SessionLog) BookDeleted() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.summary.BooksDeleted++
+}
+
+// BookSent records a book sent to Calibre
+func (s *SessionLog) BookSent(size int64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.summary.BooksSent++
+	s.summary.BytesSent += size
+}
+
+// MetadataUpdated records the number of books Calibre sent updated metadata for
+func (s *SessionLog) MetadataUpdated(count int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.summary.MetadataUpdated += count
+}
+
+// CoverGenerated records a book cover that KU generated thumbnails for
+func (s *SessionLog) CoverGenerated() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.summary.CoversGenerated++
+}
+
+// Received returns the number of books, and bytes, received so far this session
+func (s *SessionLog) Received() (int, int64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.summary.BooksReceived + s.summary.BooksReplaced, s.summary.BytesReceived
+}
+
+// AddError records an error relating to a single item
+func (s *SessionLog) AddError(item string, err error) {
+	se := SessionError{Item: item, Error: err.Error()}
+	s.mux.Lock()
+	s.summary.Errors = append(s.summary.Errors, se)
+	s.mux.Unlock()
+	if s.onError != nil {
+		s.onError(se)
+	}
+}
+
+// finish marks the end of the session, and returns the completed summary
+func (s *SessionLog) finish(result string) SessionSummary {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.summary.End = time.Now()
+	s.summary.DurationSecs = s.summary.End.Sub(s.summary.Start).Seconds()
+	s.summary.Result = result
+	summary := s.summary
+	summary.Errors = append([]SessionError(nil), s.summary.Errors...)
+	return summary
+}
+
+// readSessionHistory reads the history of previous sessions, oldest first
+func readSessionHistory(fn string) ([]SessionSummary, error) {
+	history := make([]SessionSummary, 0)
+	if _, err := util.ReadJSON(fn, &history); err != nil {
+		return history, fmt.Errorf("readSessionHistory: %w", err)
+	}
+	return history, nil
+}
+
+// appendSessionHistory adds a session summary to the history file, discarding the oldest
+// sessions if required
+func appendSessionHistory(fn string, summary SessionSummary) error {
+	history, err := readSessionHistory(fn)
+	if err != nil {
+		// Start a new history rather than losing this session as well
+		kulog.Warnf("%v", err)
+		history = history[:0]
+	}
+	history = append(history, summary)
+	if len(history) > maxSessionHistory {
+		history = history[len(history)-maxSessionHistory:]
+	}
+	if err := util.WriteJSON(fn, history); err != nil {
+		return fmt.Errorf("appendSessionHistory: %w", err)
+	}
+	return nil
+}
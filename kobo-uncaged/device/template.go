@@ -0,0 +1,213 @@
+// Copyright 2019-2020 Sherman Perry
+
+// This file is part of Kobo UNCaGED.
+
+// Kobo UNCaGED is free software: you can redistribute it and/or modify
+// it under the terms of the Affero GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Kobo UNCaGED is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with Kobo UNCaGED.  If not, see <https://www.gnu.org/licenses/>.
+
+package device
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/kulog"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// templateFields are the book fields that can be used in a template, in addition to
+// custom columns ("#name")
+var templateFields = map[string]func(md *uc.CalibreBookMeta) string{
+	"title":       func(md *uc.CalibreBookMeta) string { return md.Title },
+	"title_sort":  func(md *uc.CalibreBookMeta) string { return md.TitleSort },
+	"authors":     func(md *uc.CalibreBookMeta) string { return strings.Join(md.Authors, " & ") },
+	"author_sort": func(md *uc.CalibreBookMeta) string { return md.AuthorSort },
+	"series": func(md *uc.CalibreBookMeta) string {
+		if md.Series == nil {
+			return ""
+		}
+		return *md.Series
+	},
+	"series_index": func(md *uc.CalibreBookMeta) string {
+		if md.Series == nil || *md.Series == "" || md.SeriesIndex == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*md.SeriesIndex, 'f', -1, 64)
+	},
+	"publisher": func(md *uc.CalibreBookMeta) string { return md.PubString() },
+	"pubdate": func(md *uc.CalibreBookMeta) string {
+		if t := md.Pubdate.GetTime(); t != nil {
+			return t.Format("2006-01-02")
+		}
+		return ""
+	},
+	"languages": func(md *uc.CalibreBookMeta) string { return md.LangString() },
+	"tags":      func(md *uc.CalibreBookMeta) string { return md.TagString() },
+	"rating":    func(md *uc.CalibreBookMeta) string { return md.RatingString() },
+	"isbn":      func(md *uc.CalibreBookMeta) string { return md.Identifiers["isbn"] },
+	"uuid":      func(md *uc.CalibreBookMeta) string { return md.UUID },
+	"id":        func(md *uc.CalibreBookMeta) string { return strconv.Itoa(md.ApplicationID) },
+}
+
+// templatePart is either literal text, or a field, with text to add before and after
+// the field value if it isn't empty
+type templatePart struct {
+	text   string
+	field  string
+	prefix string
+	suffix string
+}
+
+// bookTemplate is a parsed template, such as "{series} [{series_index}] - {#genre}". As in
+// Calibre, "{series:|[|]}" adds the text between the bars before and after the field, but
+// only if the field isn't empty.
+type bookTemplate []templatePart
+
+// parseTemplate parses a book template
+func parseTemplate(tmpl string) (bookTemplate, error) {
+	var parts bookTemplate
+	for tmpl != "" {
+		start := strings.IndexByte(tmpl, '{')
+		if start < 0 {
+			start = len(tmpl)
+		}
+		if start > 0 {
+			if strings.IndexByte(tmpl[:start], '}') >= 0 {
+				return nil, fmt.Errorf("parseTemplate: unexpected '}'")
+			}
+			parts = append(parts, templatePart{text: tmpl[:start]})
+			tmpl = tmpl[start:]
+			continue
+		}
+		end := strings.IndexByte(tmpl, '}')
+		if end < 0 {
+			return nil, fmt.Errorf("parseTemplate: missing '}'")
+		}
+		var p templatePart
+		p.field = tmpl[1:end]
+		if i := strings.IndexByte(p.field, ':'); i >= 0 {
+			affix := strings.Split(p.field[i+1:], "|")
+			if len(affix) != 3 || affix[0] != "" {
+				return nil, fmt.Errorf("parseTemplate: field '%s' should be in the form {field:|prefix|suffix}", p.field)
+			}
+			p.field, p.prefix, p.suffix = p.field[:i], affix[1], affix[2]
+		}
+		if _, ok := templateFields[p.field]; !ok && !(strings.HasPrefix(p.field, "#") && len(p.field) > 1) {
+			return nil, fmt.Errorf("parseTemplate: unknown field '%s'", p.field)
+		}
+		parts = append(parts, p)
+		tmpl = tmpl[end+1:]
+	}
+	return parts, nil
+}
+
+// hasFields reports whether the template uses any fields
+func (t bookTemplate) hasFields() bool {
+	for _, p := range t {
+		if p.field != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// expand evaluates the template for md. If value isn't nil, it may change the value of
+// each field before it is used.
+func (t bookTemplate) expand(md *uc.CalibreBookMeta, value func(field, val string) string) string {
+	var sb strings.Builder
+	for _, p := range t {
+		if p.field == "" {
+			sb.WriteString(p.text)
+			continue
+		}
+		val := ""
+		if fn, ok := templateFields[p.field]; ok {
+			val = fn(md)
+		} else if cc, ok := md.UserMetadata[p.field]; ok {
+			val = cc.ContextualString()
+		}
+		if value != nil {
+			val = value(p.field, val)
+		}
+		if val != "" {
+			sb.WriteString(p.prefix)
+			sb.WriteString(val)
+			sb.WriteString(p.suffix)
+		}
+	}
+	return sb.String()
+}
+
+// evalTemplate evaluates the template tmpl for md
+func evalTemplate(tmpl string, md *uc.CalibreBookMeta) (string, error) {
+	t, err := parseTemplate(tmpl)
+	if err != nil {
+		return "", err
+	}
+	return t.expand(md, nil), nil
+}
+
+// fieldMapColumns are the text columns of Nickel's content table that can be set from a
+// template. The keys are lower case, to match column names in any case.
+var fieldMapColumns = map[string]string{
+	"title":        "Title",
+	"subtitle":     "Subtitle",
+	"attribution":  "Attribution",
+	"description":  "Description",
+	"publisher":    "Publisher",
+	"series":       "Series",
+	"seriesnumber": "SeriesNumber",
+	"language":     "Language",
+	"isbn":         "ISBN",
+}
+
+// validateFieldMap checks the column names and templates of a field map, and returns it
+// with the column names as Nickel spells them
+func validateFieldMap(fm map[string]string) (map[string]string, error) {
+	if len(fm) == 0 {
+		return nil, nil
+	}
+	valid := make(map[string]string, len(fm))
+	for col, tmpl := range fm {
+		name, ok := fieldMapColumns[strings.ToLower(strings.TrimSpace(col))]
+		if !ok {
+			return nil, fmt.Errorf("validateFieldMap: '%s' is not a column that can be mapped", col)
+		}
+		if _, err := parseTemplate(tmpl); err != nil {
+			return nil, fmt.Errorf("validateFieldMap: %s: %w", name, err)
+		}
+		valid[name] = tmpl
+	}
+	return valid, nil
+}
+
+// mapNickelFields evaluates the templates of a field map for md. Columns whose template
+// evaluates to an empty string are set to NULL, except the title, which Nickel requires.
+func mapNickelFields(md *uc.CalibreBookMeta, fm map[string]string) map[string]*string {
+	vals := make(map[string]*string, len(fm))
+	for col, tmpl := range fm {
+		val, err := evalTemplate(tmpl, md)
+		if err != nil {
+			// The field map is validated when it is saved, so this shouldn't happen
+			kulog.Warnf("Ignoring template for %s: %v", col, err)
+			continue
+		}
+		val = strings.TrimSpace(val)
+		if val == "" && col == "Title" {
+			continue
+		}
+		vals[col] = optString(val)
+	}
+	return vals
+}
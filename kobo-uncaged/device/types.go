@@ -23,11 +23,13 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/bamiaux/rez"
 	"github.com/godbus/dbus/v5"
 	"github.com/julienschmidt/httprouter"
 	"github.com/pgaskin/koboutils/v2/kobo"
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
 	"github.com/shermp/UNCaGED/uc"
 	"github.com/unrolled/render"
 )
@@ -38,41 +40,121 @@ type firmwareVersion string
 
 // KuOptions contains some options that are required
 type KuOptions struct {
-	PreferSDCard    bool                    `json:"preferSDCard"`
-	PreferKepub     bool                    `json:"preferKepub"`
-	EnableDebug     bool                    `json:"enableDebug"`
-	Thumbnail       thumbnailOption         `json:"thumbnail"`
-	LibOptions      map[string]KuLibOptions `json:"libOptions"`
-	DirectConnIndex int                     `json:"directConnIndex"`
-	DirectConn      []uc.CalInstance        `json:"directConn"`
+	Version          int                     `json:"version"`
+	PreferSDCard     bool                    `json:"preferSDCard"`
+	PreferKepub      bool                    `json:"preferKepub"`
+	EnableDebug      bool                    `json:"enableDebug"`
+	DisablePassCache bool                    `json:"disablePassCache"`
+	ReserveSpaceMB   int                     `json:"reserveSpaceMB"`
+	LpathTemplate    string                  `json:"lpathTemplate"`
+	SanitizeProfile  string                  `json:"sanitizeProfile"`
+	MetadataBackend  string                  `json:"metadataBackend"`
+	SeriesAliases    map[string]string       `json:"seriesAliases"`
+	NickelFields     nickelFieldOptions      `json:"nickelFields"`
+	Thumbnail        thumbnailOption         `json:"thumbnail"`
+	LibOptions       map[string]KuLibOptions `json:"libOptions"`
+	LastLibrary      string                  `json:"lastLibrary"`
+	DirectConnIndex  int                     `json:"directConnIndex"`
+	DirectConn       []uc.CalInstance        `json:"directConn"`
 }
 
-// KuLibOptions contains per-library options
+// KuLibOptions contains per-library options. Options that are nil use the global setting.
 type KuLibOptions struct {
-	SubtitleColumn string `json:"subtitleColumn"`
+	LibraryName       string            `json:"libraryName"`
+	SubtitleColumn    string            `json:"subtitleColumn"`
+	FieldMap          map[string]string `json:"fieldMap"`
+	CollectionColumns []string          `json:"collectionColumns"`
+	ReadStatusColumn  string            `json:"readStatusColumn"`
+	PreferSDCard      *bool             `json:"preferSDCard"`
+	PreferKepub       *bool             `json:"preferKepub"`
+	Thumbnail         *thumbnailOption  `json:"thumbnail"`
+	LpathTemplate     *string           `json:"lpathTemplate"`
 }
 
 type webUIinfo struct {
-	KUVersion      string `json:"kuVersion"`
-	StorageType    string `json:"storageType"`
-	ScreenDPI      int    `json:"screenDPI"`
-	ExitPath       string `json:"exitPath"`
-	DisconnectPath string `json:"disconnectPath"`
-	AuthPath       string `json:"authPath"`
-	SSEPath        string `json:"ssePath"`
-	ConfigPath     string `json:"configPath"`
-	InstancePath   string `json:"instancePath"`
-	LibInfoPath    string `json:"libInfoPath"`
+	KUVersion       string `json:"kuVersion"`
+	StorageType     string `json:"storageType"`
+	ScreenDPI       int    `json:"screenDPI"`
+	ExitPath        string `json:"exitPath"`
+	DisconnectPath  string `json:"disconnectPath"`
+	AuthPath        string `json:"authPath"`
+	SSEPath         string `json:"ssePath"`
+	ConfigPath      string `json:"configPath"`
+	ConfigExpPath   string `json:"configExpPath"`
+	ConfigImpPath   string `json:"configImpPath"`
+	ConfigResetPath string `json:"configResetPath"`
+	InstancePath    string `json:"instancePath"`
+	LibInfoPath     string `json:"libInfoPath"`
+	LibraryPath     string `json:"libraryPath"`
+	LibCoverPath    string `json:"libCoverPath"`
+	LibDeletePath   string `json:"libDeletePath"`
+	DiagnosticsPath string `json:"diagnosticsPath"`
+	VerifyPath      string `json:"verifyPath"`
+	StoragePath     string `json:"storagePath"`
+	MigratePath     string `json:"migratePath"`
+	HasSDCard       bool   `json:"hasSDCard"`
+	AuthToken       string `json:"authToken"`
 }
 
 type webConfig struct {
-	Opts KuOptions `json:"opts"`
-	err  error
+	Opts    KuOptions `json:"opts"`
+	Warning string    `json:"warning,omitempty"`
+	err     error
 }
 
 type webLibOpts struct {
-	CurrSel        int      `json:"currSel"`
-	SubtitleFields []string `json:"subtitleFields"`
+	CurrSel           int               `json:"currSel"`
+	SubtitleFields    []string          `json:"subtitleFields"`
+	FieldMap          map[string]string `json:"fieldMap"`
+	CollectionColumns []string          `json:"collectionColumns"`
+	ReadStatusColumn  string            `json:"readStatusColumn"`
+	ReadStatusFields  []string          `json:"readStatusFields"` // The yes/no columns of the library
+	Notice            string            `json:"notice,omitempty"`
+}
+
+// libraryBook is a summary of a single book, as displayed in the web UI library browser
+type libraryBook struct {
+	ContentID    string   `json:"contentID"`
+	Title        string   `json:"title"`
+	Authors      []string `json:"authors"`
+	Series       string   `json:"series"`
+	SeriesIndex  float64  `json:"seriesIndex"`
+	Size         int      `json:"size"`
+	MarkedDelete bool     `json:"markedDelete"`
+	titleSort    string
+	authorSort   string
+}
+
+type libraryPage struct {
+	Total   int           `json:"total"`
+	Page    int           `json:"page"`
+	PerPage int           `json:"perPage"`
+	Books   []libraryBook `json:"books"`
+}
+
+// diagnostics collects information useful for debugging user reports
+type diagnostics struct {
+	KUVersion      string           `json:"kuVersion"`
+	DeviceModel    string           `json:"deviceModel"`
+	Firmware       string           `json:"firmware"`
+	StorageType    string           `json:"storageType"`
+	FreeSpace      uint64           `json:"freeSpace"`
+	FreeSpaceError string           `json:"freeSpaceError,omitempty"`
+	Config         KuOptions        `json:"config"`
+	Sessions       []SessionSummary `json:"sessions"`
+	RecentLog      []string         `json:"recentLog"`
+}
+
+// deleteMark records a book the user has marked for deletion. The UUID is used
+// to make sure a different book hasn't replaced it before the deletion happens.
+type deleteMark struct {
+	Title string `json:"title"`
+	UUID  string `json:"uuid"`
+}
+
+type libraryDelete struct {
+	ContentID string `json:"contentID"`
+	Marked    bool   `json:"marked"`
 }
 
 // WebMsg is used to send messages to the web client
@@ -83,6 +165,45 @@ type WebMsg struct {
 	GetCalInstance bool
 	GetLibInfo     bool
 	Finished       string
+	Summary        *SessionSummary
+	Transfer       *TransferProgress
+	Error          *SessionError
+}
+
+// The following are the payloads of events sent to the web UI.
+// See docs/web-events.md before changing them.
+
+type messageEvent struct {
+	Message string `json:"message"`
+}
+
+type progressEvent struct {
+	Percent int `json:"percent"`
+}
+
+type authEvent struct {
+	LibName  string `json:"libName"`
+	Attempts int    `json:"attempts"`
+}
+
+type instancesEvent struct {
+	Instances []uc.CalInstance `json:"instances"`
+}
+
+type finishedEvent struct {
+	Message string          `json:"message"`
+	Summary *SessionSummary `json:"summary,omitempty"`
+}
+
+// TransferProgress reports the progress of the book currently being received from Calibre
+type TransferProgress struct {
+	Title         string  `json:"title"`
+	BookBytes     int64   `json:"bookBytes"`
+	BookSize      int64   `json:"bookSize"`
+	BooksReceived int     `json:"booksReceived"`
+	SessionBytes  int64   `json:"sessionBytes"`
+	Rate          float64 `json:"rate"`
+	ETASecs       float64 `json:"etaSecs"`
 }
 
 type calPassCache map[string]*calPassword
@@ -96,40 +217,67 @@ type calPassword struct {
 // Kobo contains the variables and methods required to use
 // the UNCaGED library
 type Kobo struct {
-	KuVers          string
-	Device          kobo.Device
-	fw              firmwareVersion
-	KuConfig        *KuOptions
-	DBRootDir       string
-	BKRootDir       string
-	ContentIDprefix cidPrefix
-	UseSDCard       bool
-	MetadataMap     map[string]uc.CalibreBookMeta
-	UpdatedMetadata map[string]struct{}
-	BooksInDB       map[string]struct{}
-	SeriesIDMap     map[string]string
-	LibInfo         uc.CalibreLibraryInfo
-	PassCache       calPassCache
-	DriveInfo       uc.DeviceInfo
-	Wg              *sync.WaitGroup
-	mux             *httprouter.Router
-	rend            *render.Render
-	webInfo         *webUIinfo
-	replSQLWriter   *sqlWriter
-	ndbConn         *dbus.Conn
-	ndbObj          dbus.BusObject
-	calInstances    []uc.CalInstance
-	useNDB          bool
-	FinishedMsg     string
-	BrowserOpen     bool
-	doneChan        chan bool
-	startChan       chan webConfig
-	MsgChan         chan WebMsg
-	AuthChan        chan *calPassword
-	exitChan        chan bool
-	UCExitChan      chan<- bool
-	calInstChan     chan uc.CalInstance
-	viewSignal      chan *dbus.Signal
+	KuVers           string
+	Device           kobo.Device
+	fw               firmwareVersion
+	serial           string
+	KuConfig         *KuOptions
+	effOpts          *KuOptions // KuConfig, with the profile of the current library applied
+	libNotice        string     // Profile options that can't be applied until the next connection
+	configWarning    string     // Why the config file couldn't be read, if it couldn't
+	cfgMux           sync.RWMutex
+	DBRootDir        string
+	SDRootDir        string
+	BKRootDir        string
+	ContentIDprefix  cidPrefix
+	UseSDCard        bool
+	md               mdStore
+	mdMux            sync.RWMutex
+	mdLoadMux        sync.Mutex
+	deleteQueue      map[string]deleteMark
+	bookInfo         map[string]bookInfo
+	mdDirty          bool
+	mdWriteMux       sync.Mutex
+	mdTimerMux       sync.Mutex
+	mdWriteTimer     *time.Timer
+	lpathAliases     map[string]string
+	migrationPending bool
+	sessionMux       sync.Mutex
+	sessionStarted   bool // Guarded by sessionMux
+	migrated         map[string]storageBook
+	requestedLpaths  map[string]string
+	journalMux       sync.Mutex
+	journal          transferJournal
+	UpdatedMetadata  map[string]struct{}
+	BooksInDB        map[string]struct{}
+	SeriesIDMap      map[string]string
+	LibInfo          uc.CalibreLibraryInfo
+	PassCache        calPassCache
+	DriveInfo        uc.DeviceInfo
+	Session          *SessionLog
+	recentLog        *util.LogRing
+	Wg               *sync.WaitGroup
+	mux              *httprouter.Router
+	rend             *render.Render
+	webInfo          *webUIinfo
+	authToken        string
+	replSQLWriter    *sqlWriter
+	ndbConn          *dbus.Conn
+	ndbObj           dbus.BusObject
+	calInstances     []uc.CalInstance
+	useNDB           bool
+	FinishedMsg      string
+	BrowserOpen      bool
+	events           *eventBus
+	dialogMux        sync.Mutex
+	pendingAuth      *calPassword
+	pendingInstance  bool
+	startChan        chan webConfig
+	AuthChan         chan *calPassword
+	exitChan         chan bool
+	UCExitChan       chan<- bool
+	calInstChan      chan uc.CalInstance
+	viewSignal       chan *dbus.Signal
 }
 
 // MetaIterator Kobo UNCaGED to lazy load book metadata
@@ -167,7 +315,7 @@ func (m *MetaIterator) Count() int {
 // Get the metadata of the current iteration
 func (m *MetaIterator) Get() (uc.CalibreBookMeta, error) {
 	if m.Count() > 0 && m.cidIndex >= 0 {
-		if md, exists := m.k.MetadataMap[m.cidList[m.cidIndex]]; exists {
+		if md, exists := m.k.GetMetadata(m.cidList[m.cidIndex]); exists {
 			return md, nil
 		}
 	}
@@ -200,11 +348,16 @@ const (
 	resizeLC3 string = "lanczos3"
 )
 
-func (to *thumbnailOption) Validate() {
+// Validate replaces invalid thumbnail options with their defaults, and describes each option
+// that was set, but had to be replaced
+func (to *thumbnailOption) Validate() (fixed []string) {
 	switch strings.ToLower(to.GenerateLevel) {
 	case generateAll, generatePartial, generateNone:
 		to.GenerateLevel = strings.ToLower(to.GenerateLevel)
 	default:
+		if to.GenerateLevel != "" {
+			fixed = append(fixed, fmt.Sprintf("thumbnail level '%s' is invalid, using '%s'", to.GenerateLevel, generateAll))
+		}
 		to.GenerateLevel = generateAll
 	}
 
@@ -212,12 +365,19 @@ func (to *thumbnailOption) Validate() {
 	case resizeBL, resizeBC, resizeLC2, resizeLC3:
 		to.ResizeAlgorithm = strings.ToLower(to.ResizeAlgorithm)
 	default:
+		if to.ResizeAlgorithm != "" {
+			fixed = append(fixed, fmt.Sprintf("thumbnail resize algorithm '%s' is invalid, using '%s'", to.ResizeAlgorithm, resizeBC))
+		}
 		to.ResizeAlgorithm = resizeBC
 	}
 
 	if to.JpegQuality < 1 || to.JpegQuality > 100 {
+		if to.JpegQuality != 0 {
+			fixed = append(fixed, fmt.Sprintf("thumbnail JPEG quality %d is not between 1 and 100, using 90", to.JpegQuality))
+		}
 		to.JpegQuality = 90
 	}
+	return fixed
 }
 
 func (to *thumbnailOption) SetRezFilter() {
@@ -267,6 +427,14 @@ func (s *sqlWriter) writeQuery(query string) {
 	s.sqlBuffWriter.WriteRune('\n')
 }
 
+// sync writes buffered queries to disk
+func (s *sqlWriter) sync() error {
+	if err := s.sqlBuffWriter.Flush(); err != nil {
+		return err
+	}
+	return s.sqlFile.Sync()
+}
+
 func (s *sqlWriter) close() {
 	defer s.sqlFile.Close()
 	s.sqlBuffWriter.Flush()
@@ -0,0 +1,196 @@
+// Copyright 2019-2020 Sherman Perry
+
+// This file is part of Kobo UNCaGED.
+
+// Kobo UNCaGED is free software: you can redistribute it and/or modify
+// it under the terms of the Affero GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Kobo UNCaGED is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with Kobo UNCaGED.  If not, see <https://www.gnu.org/licenses/>.
+
+package device
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/kulog"
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// kuBookInfo holds the size and hash of each book KU received. It is kept apart from
+// metadata.calibre because Calibre rewrites that file when connected over USB, dropping
+// any fields it doesn't know about.
+const kuBookInfo = ".adds/kobo-uncaged/bookinfo.json"
+
+// bookInfo is what KU knows about a book file, in addition to the Calibre metadata
+type bookInfo struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// RequestedLpath is the lpath Calibre asked for, if the book was saved elsewhere
+	RequestedLpath string `json:"requestedLpath,omitempty"`
+}
+
+// libraryProblem describes a book that failed verification
+type libraryProblem struct {
+	ContentID string `json:"contentID"`
+	Title     string `json:"title"`
+	Problem   string `json:"problem"`
+}
+
+// hashFile returns the hex encoded SHA256 hash of a file
+func hashFile(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyBookFile checks the size of a book file, and that EPUB/KEPUB/CBZ files are readable
+// ZIP archives. If sha256 is not empty, the file hash is checked as well. fn is the file
+// to check, which may differ from the book path while the book is being received.
+func verifyBookFile(fn, bkPath string, size int64, sha256 string) error {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return fmt.Errorf("verifyBookFile: %w", err)
+	}
+	if fi.Size() != size {
+		return fmt.Errorf("verifyBookFile: expected %d bytes, found %d bytes", size, fi.Size())
+	}
+	if util.IsZipBook(bkPath) {
+		if err = util.CheckZip(fn); err != nil {
+			return fmt.Errorf("verifyBookFile: %w", err)
+		}
+	}
+	if sha256 != "" {
+		fileHash, err := hashFile(fn)
+		if err != nil {
+			return fmt.Errorf("verifyBookFile: error hashing book: %w", err)
+		}
+		if fileHash != sha256 {
+			return fmt.Errorf("verifyBookFile: checksum mismatch")
+		}
+	}
+	return nil
+}
+
+// VerifyBookFile checks that a newly transferred book was written correctly to fn, by
+// reading it back and comparing it against the size and hash of the data received
+func (k *Kobo) VerifyBookFile(fn, bkPath string, size int64, sha256 string) error {
+	return verifyBookFile(fn, bkPath, size, sha256)
+}
+
+// storedBookInfo returns the book info for cid, if it still describes the book. Info
+// recorded for a file since replaced outside of KU (eg: by Calibre over USB) is ignored.
+// The caller must hold mdMux.
+func (k *Kobo) storedBookInfo(cid string, md uc.CalibreBookMeta) (bookInfo, bool) {
+	bi, exists := k.bookInfo[cid]
+	if !exists || (md.Size > 0 && int64(md.Size) != bi.Size) {
+		return bookInfo{}, false
+	}
+	return bi, true
+}
+
+// VerifyStoredBook checks the copy of a book already on the device against the size and
+// hash recorded when it was received. Books without recorded info are not checked.
+func (k *Kobo) VerifyStoredBook(cid string) error {
+	k.mdMux.RLock()
+	e, exists := k.getMDentry(cid)
+	var bi bookInfo
+	if exists {
+		bi, exists = k.storedBookInfo(cid, e.md)
+	}
+	k.mdMux.RUnlock()
+	if !exists {
+		return nil
+	}
+	bkPath := util.ContentIDtoBkPath(k.BKRootDir, cid, string(k.ContentIDprefix))
+	if err := verifyBookFile(bkPath, bkPath, bi.Size, bi.SHA256); err != nil {
+		return fmt.Errorf("VerifyStoredBook: %w", err)
+	}
+	return nil
+}
+
+// SetBookInfo records the size and hash of a book file, so it can be verified later, and
+// the lpath Calibre requested, if the book was saved elsewhere
+func (k *Kobo) SetBookInfo(cid string, size int64, sha256, requestedLpath string) {
+	k.mdMux.Lock()
+	defer k.mdMux.Unlock()
+	k.bookInfo[cid] = bookInfo{Size: size, SHA256: sha256, RequestedLpath: requestedLpath}
+	k.mdDirty = true
+}
+
+// readBookInfo reads the book info file. Entries for books no longer in books are dropped.
+// Entries for books on the storage not currently in use are kept.
+func (k *Kobo) readBookInfo(books map[string]struct{}) map[string]bookInfo {
+	bi := make(map[string]bookInfo)
+	if _, err := util.ReadJSON(filepath.Join(k.DBRootDir, kuBookInfo), &bi); err != nil {
+		// Not fatal, books without info can still be partially verified
+		kulog.Warnf("%v", err)
+	}
+	for cid := range bi {
+		if !strings.HasPrefix(cid, string(k.ContentIDprefix)) {
+			continue
+		}
+		if _, exists := books[cid]; !exists {
+			delete(bi, cid)
+		}
+	}
+	return bi
+}
+
+// VerifyLibrary checks every book on the device, and reports any that are missing or
+// corrupt. Books without recorded info, such as those transferred before KU recorded file
+// hashes, only have their format checked.
+func (k *Kobo) VerifyLibrary() ([]libraryProblem, error) {
+	if err := k.loadMetadata(); err != nil {
+		return nil, fmt.Errorf("VerifyLibrary: %w", err)
+	}
+	type book struct {
+		cid, title string
+		info       bookInfo
+		hasInfo    bool
+	}
+	var books []book
+	err := k.EachMetadata(func(cid string, md uc.CalibreBookMeta) {
+		bi, hasInfo := k.storedBookInfo(cid, md)
+		books = append(books, book{cid: cid, title: md.Title, info: bi, hasInfo: hasInfo})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("VerifyLibrary: %w", err)
+	}
+
+	problems := make([]libraryProblem, 0)
+	for _, bk := range books {
+		bkPath := util.ContentIDtoBkPath(k.BKRootDir, bk.cid, string(k.ContentIDprefix))
+		if bk.hasInfo {
+			err = verifyBookFile(bkPath, bkPath, bk.info.Size, bk.info.SHA256)
+		} else if _, err = os.Stat(bkPath); err == nil && util.IsZipBook(bkPath) {
+			err = util.CheckZip(bkPath)
+		}
+		if err != nil {
+			kulog.Warnf("VerifyLibrary: %s: %v", bk.cid, err)
+			problems = append(problems, libraryProblem{ContentID: bk.cid, Title: bk.title, Problem: err.Error()})
+		}
+	}
+	return problems, nil
+}
@@ -1,13 +1,22 @@
 package device
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/pgaskin/koboutils/v2/kobo"
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/kulog"
 	"github.com/shermp/UNCaGED/uc"
 	"github.com/unrolled/render"
 )
@@ -15,6 +24,21 @@ import (
 // IgnoreProgress tells HandleMessage not to send progress value to web UI
 const IgnoreProgress int = -127
 
+// webEventHistory is the number of events kept to replay to reconnecting web clients
+const webEventHistory = 64
+
+// webEventBuffer is the number of events that may be queued for a single web client
+const webEventBuffer = 64
+
+// finishedFlushTimeout is how long to wait for web clients to receive the finished message
+const finishedFlushTimeout = 3 * time.Second
+
+const (
+	tokenCookie = "ku_token"
+	tokenHeader = "X-KU-Token"
+	tokenQuery  = "token"
+)
+
 func (k *Kobo) initWeb() {
 	k.initRouter()
 	k.initRender()
@@ -26,6 +50,12 @@ func (k *Kobo) initRouter() {
 	k.webInfo.ConfigPath = "/config"
 	k.mux.HandlerFunc("GET", k.webInfo.ConfigPath, k.HandleConfig)
 	k.mux.HandlerFunc("POST", k.webInfo.ConfigPath, k.HandleConfig)
+	k.webInfo.ConfigExpPath = "/config/export"
+	k.mux.HandlerFunc("GET", k.webInfo.ConfigExpPath, k.HandleConfigExport)
+	k.webInfo.ConfigImpPath = "/config/import"
+	k.mux.HandlerFunc("POST", k.webInfo.ConfigImpPath, k.HandleConfigImport)
+	k.webInfo.ConfigResetPath = "/config/reset"
+	k.mux.HandlerFunc("POST", k.webInfo.ConfigResetPath, k.HandleConfigReset)
 	k.webInfo.ExitPath = "/exit"
 	k.mux.HandlerFunc("GET", k.webInfo.ExitPath, k.HandleExit)
 	k.webInfo.SSEPath = "/messages"
@@ -41,9 +71,55 @@ func (k *Kobo) initRouter() {
 	k.mux.HandlerFunc("POST", k.webInfo.LibInfoPath, k.HandleLibraryInfo)
 	k.webInfo.DisconnectPath = "/ucexit"
 	k.mux.HandlerFunc("GET", k.webInfo.DisconnectPath, k.HandleUCExit)
+	k.webInfo.LibraryPath = "/library"
+	k.mux.HandlerFunc("GET", k.webInfo.LibraryPath, k.HandleLibrary)
+	k.webInfo.LibCoverPath = "/library/cover"
+	k.mux.HandlerFunc("GET", k.webInfo.LibCoverPath, k.HandleLibraryCover)
+	k.webInfo.LibDeletePath = "/library/delete"
+	k.mux.HandlerFunc("POST", k.webInfo.LibDeletePath, k.HandleLibraryDelete)
+	k.webInfo.DiagnosticsPath = "/diagnostics"
+	k.mux.HandlerFunc("GET", k.webInfo.DiagnosticsPath, k.HandleDiagnostics)
+	k.webInfo.VerifyPath = "/diagnostics/verify"
+	k.mux.HandlerFunc("POST", k.webInfo.VerifyPath, k.HandleVerifyLibrary)
+	k.webInfo.StoragePath = "/storage"
+	k.mux.HandlerFunc("GET", k.webInfo.StoragePath, k.HandleStorage)
+	k.webInfo.MigratePath = "/storage/migrate"
+	k.mux.HandlerFunc("POST", k.webInfo.MigratePath, k.HandleMigrate)
 	k.mux.ServeFiles("/static/*filepath", http.Dir("./static"))
 }
 
+// requireToken rejects any request that does not carry this session's auth token.
+// The token may be provided as a header, a query parameter or a cookie. The cookie
+// is set the first time a valid token is seen, so that static resources loaded by
+// the page are also authorized.
+func (k *Kobo) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, fromCookie := r.Header.Get(tokenHeader), false
+		if token == "" {
+			token = r.URL.Query().Get(tokenQuery)
+		}
+		if token == "" {
+			if c, err := r.Cookie(tokenCookie); err == nil {
+				token, fromCookie = c.Value, true
+			}
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(k.authToken)) != 1 {
+			http.Error(w, "invalid or missing access token", http.StatusForbidden)
+			return
+		}
+		if !fromCookie {
+			http.SetCookie(w, &http.Cookie{
+				Name:     tokenCookie,
+				Value:    k.authToken,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (k *Kobo) initRender() {
 	k.rend = render.New(render.Options{
 		Directory:     "templates",
@@ -55,6 +131,7 @@ func (k *Kobo) initRender() {
 // HandleIndex displays a form allowing the user to customize
 // KU. It uses the existing ku.toml file as a seed
 func (k *Kobo) HandleIndex(w http.ResponseWriter, r *http.Request) {
+	k.webInfo.AuthToken = k.authToken
 	k.rend.HTML(w, http.StatusOK, "kuPage", k.webInfo)
 }
 
@@ -69,55 +146,106 @@ func (k *Kobo) HandleExit(w http.ResponseWriter, r *http.Request) {
 func (k *Kobo) HandleConfig(w http.ResponseWriter, r *http.Request) {
 	res := webConfig{}
 	if r.Method == http.MethodGet {
-		res.Opts = *k.KuConfig
+		res.Opts = k.config()
+		res.Warning = k.configWarning
 		k.rend.JSON(w, http.StatusOK, res)
 	} else {
-		defer close(k.startChan)
 		if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
 			http.Error(w, "error getting config from client", http.StatusInternalServerError)
+			return
 		}
+		if err := validateUserOptions(&res.Opts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := k.startSession(); errors.Is(err, ErrMigrationPending) {
+			http.Error(w, "Books have been moved between storages. Please exit, and start KU again to connect to Calibre.", http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "KU has already been started", http.StatusConflict)
+			return
+		}
+		defer close(k.startChan)
 		k.startChan <- res
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
+// HandleConfigExport downloads the current config
+func (k *Kobo) HandleConfigExport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Disposition", `attachment; filename="kuconfig.json"`)
+	k.rend.JSON(w, http.StatusOK, k.config())
+}
+
+// HandleConfigImport checks an uploaded config, and sends it back to be shown on the config
+// page. Like any other change, it is only saved when the user presses Start.
+func (k *Kobo) HandleConfigImport(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxConfigSize+1))
+	if err != nil {
+		http.Error(w, "error reading config from client", http.StatusInternalServerError)
+		return
+	}
+	if len(data) > maxConfigSize {
+		http.Error(w, "The config file is too large", http.StatusBadRequest)
+		return
+	}
+	opts, notes, err := parseUserOptions(data, true)
+	if err == nil {
+		err = validateUserOptions(opts)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid config: %v", err), http.StatusBadRequest)
+		return
+	}
+	res := webConfig{Opts: *opts}
+	if len(notes) > 0 {
+		res.Warning = "Changes: " + strings.Join(notes, "; ") + "."
+	}
+	k.rend.JSON(w, http.StatusOK, res)
+}
+
+// HandleConfigReset sends the default config, to be shown on the config page
+func (k *Kobo) HandleConfigReset(w http.ResponseWriter, r *http.Request) {
+	k.rend.JSON(w, http.StatusOK, webConfig{Opts: *defaultUserOptions()})
+}
+
 // HandleMessages sends messages to the client using server sent events.
 func (k *Kobo) HandleMessages(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
 	f, ok := w.(http.Flusher)
 	if !ok {
 		http.Error(w, "ResponseWriter not a flusher", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Browsers send the ID of the last event they received when reconnecting
+	lastID, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	sub, replay := k.events.subscribe(lastID)
+	defer k.events.unsubscribe(sub)
+	writeEvent := func(ev webEvent) {
+		fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.id, ev.name, ev.data)
+	}
+	var last uint64
+	for _, ev := range replay {
+		writeEvent(ev)
+		if ev.id > last {
+			last = ev.id
+		}
 	}
+	f.Flush()
+	k.events.markDelivered(sub, last)
 	for {
 		select {
-		case msg := <-k.MsgChan:
-			if !msg.GetPassword && !msg.GetCalInstance && !msg.GetLibInfo && msg.Finished == "" {
-				// Note, we replace all newlines in the message with spaces. That is because server
-				// sent events are newline delimited
-				if msg.ShowMessage != "" {
-					fmt.Fprintf(w, "event: showMessage\ndata: %s\n\n", strings.ReplaceAll(msg.ShowMessage, "\n", " "))
-					f.Flush()
-				}
-				if msg.Progress != IgnoreProgress {
-					fmt.Fprintf(w, "event: progress\ndata: %d\n\n", msg.Progress)
-					f.Flush()
-				}
-			} else if msg.GetPassword {
-				fmt.Fprintf(w, "event: auth\ndata: %s\n\n", "")
-				f.Flush()
-			} else if msg.GetCalInstance {
-				fmt.Fprintf(w, "event: calibreInstances\ndata: %s\n\n", "")
-				f.Flush()
-			} else if msg.GetLibInfo {
-				fmt.Fprintf(w, "event: libInfo\ndata: %s\n\n", "")
-				f.Flush()
-			} else if msg.Finished != "" {
-				fmt.Fprintf(w, "event: kuFinished\ndata: %s\n\n", strings.ReplaceAll(msg.Finished, "\n", " "))
-				f.Flush()
+		case ev, ok := <-sub.ch:
+			if !ok {
+				// We fell behind, and were dropped by the event bus. The browser
+				// will reconnect and catch up from the history.
+				return
 			}
-			k.doneChan <- true
+			writeEvent(ev)
+			f.Flush()
+			k.events.markDelivered(sub, ev.id)
 		case <-r.Context().Done():
 			return
 		}
@@ -126,14 +254,23 @@ func (k *Kobo) HandleMessages(w http.ResponseWriter, r *http.Request) {
 
 // HandleCalAuth gets user supplied password
 func (k *Kobo) HandleCalAuth(w http.ResponseWriter, r *http.Request) {
+	k.dialogMux.Lock()
+	defer k.dialogMux.Unlock()
+	if k.pendingAuth == nil {
+		http.Error(w, "no password requested", http.StatusNotFound)
+		return
+	}
 	if r.Method == http.MethodGet {
-		pwInfo := <-k.AuthChan
-		k.rend.JSON(w, http.StatusOK, pwInfo)
+		k.rend.JSON(w, http.StatusOK, authEvent{LibName: k.pendingAuth.LibName, Attempts: k.pendingAuth.Attempts})
 	} else {
 		var pw calPassword
 		if err := json.NewDecoder(r.Body).Decode(&pw); err != nil {
 			http.Error(w, "error getting password from client", http.StatusInternalServerError)
+			return
 		}
+		kulog.Redact(pw.Password)
+		k.pendingAuth = nil
+		k.events.clearSticky("auth")
 		k.AuthChan <- &pw
 		w.WriteHeader(http.StatusNoContent)
 	}
@@ -141,58 +278,103 @@ func (k *Kobo) HandleCalAuth(w http.ResponseWriter, r *http.Request) {
 
 // HandleCalInstances gets the user selected calibre instance to connect to
 func (k *Kobo) HandleCalInstances(w http.ResponseWriter, r *http.Request) {
+	k.dialogMux.Lock()
+	defer k.dialogMux.Unlock()
 	if r.Method == http.MethodGet {
 		k.rend.JSON(w, http.StatusOK, k.calInstances)
 	} else {
+		if !k.pendingInstance {
+			http.Error(w, "no calibre instance requested", http.StatusNotFound)
+			return
+		}
 		var instance uc.CalInstance
 		if err := json.NewDecoder(r.Body).Decode(&instance); err != nil {
 			http.Error(w, "error getting calibre instance from client", http.StatusInternalServerError)
+			return
 		}
+		k.pendingInstance = false
+		k.events.clearSticky("calibreInstances")
 		k.calInstChan <- instance
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
-// HandleLibraryInfo gets and sets library specific config/info
-func (k *Kobo) HandleLibraryInfo(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodGet {
-		stdFields := make([]string, 0)
-		userFields := make([]string, 0)
-		allFields := []string{""}
-		selField := ""
-		if libOpt, exists := k.KuConfig.LibOptions[k.LibInfo.LibraryUUID]; exists {
-			selField = libOpt.SubtitleColumn
-		}
-		for name, field := range k.LibInfo.FieldMetadata {
-			switch name {
-			case "languages", "tags", "rating", "publisher":
-				stdFields = append(stdFields, name)
-			default:
-				if field.IsCustom {
-					userFields = append(userFields, name)
+// libraryOptions lists the fields of the current Calibre library that can be used as the subtitle
+// or read status, and the other options of the library
+func (k *Kobo) libraryOptions() webLibOpts {
+	stdFields := make([]string, 0)
+	userFields := make([]string, 0)
+	allFields := []string{""}
+	boolFields := []string{""}
+	libInfo, libOpt := k.currentLibrary()
+	selField := libOpt.SubtitleColumn
+	for name, field := range libInfo.FieldMetadata {
+		switch name {
+		case "languages", "tags", "rating", "publisher":
+			stdFields = append(stdFields, name)
+		default:
+			if field.IsCustom {
+				userFields = append(userFields, name)
+				if field.Datatype == "bool" {
+					boolFields = append(boolFields, name)
 				}
 			}
 		}
-		sort.Strings(stdFields)
-		sort.Strings(userFields)
-		allFields = append(allFields, stdFields...)
-		allFields = append(allFields, userFields...)
-		wlo := webLibOpts{CurrSel: 0, SubtitleFields: allFields}
-		for i, field := range allFields {
-			if field == selField {
-				wlo.CurrSel = i
-			}
+	}
+	sort.Strings(stdFields)
+	sort.Strings(userFields)
+	sort.Strings(boolFields)
+	allFields = append(allFields, stdFields...)
+	allFields = append(allFields, userFields...)
+	wlo := webLibOpts{
+		CurrSel:           0,
+		SubtitleFields:    allFields,
+		FieldMap:          libOpt.FieldMap,
+		CollectionColumns: libOpt.CollectionColumns,
+		ReadStatusColumn:  libOpt.ReadStatusColumn,
+		ReadStatusFields:  boolFields,
+		Notice:            k.notice(),
+	}
+	for i, field := range allFields {
+		if field == selField {
+			wlo.CurrSel = i
 		}
-		k.rend.JSON(w, http.StatusOK, wlo)
+	}
+	return wlo
+}
+
+// HandleLibraryInfo gets and sets library specific config/info
+func (k *Kobo) HandleLibraryInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		k.rend.JSON(w, http.StatusOK, k.libraryOptions())
 	} else {
 		var wlo webLibOpts
 		if err := json.NewDecoder(r.Body).Decode(&wlo); err != nil {
-			http.Error(w, "error getting subtitle field from client", http.StatusInternalServerError)
+			http.Error(w, "error getting library options from client", http.StatusBadRequest)
+			return
 		}
-		if k.KuConfig.LibOptions == nil {
-			k.KuConfig.LibOptions = make(map[string]KuLibOptions)
+		if wlo.CurrSel < 0 || wlo.CurrSel >= len(wlo.SubtitleFields) {
+			http.Error(w, "invalid subtitle column", http.StatusBadRequest)
+			return
+		}
+		fieldMap, err := validateFieldMap(wlo.FieldMap)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		k.KuConfig.LibOptions[k.LibInfo.LibraryUUID] = KuLibOptions{SubtitleColumn: wlo.SubtitleFields[wlo.CurrSel]}
+		cols := KuLibOptions{CollectionColumns: wlo.CollectionColumns, ReadStatusColumn: wlo.ReadStatusColumn}
+		if err = validateLibColumns(cols); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		k.cfgMux.Lock()
+		k.updateLibOptions(k.LibInfo.LibraryUUID, func(lo *KuLibOptions) {
+			lo.SubtitleColumn = wlo.SubtitleFields[wlo.CurrSel]
+			lo.FieldMap = fieldMap
+			lo.CollectionColumns = cols.CollectionColumns
+			lo.ReadStatusColumn = cols.ReadStatusColumn
+		})
+		k.cfgMux.Unlock()
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
@@ -207,8 +389,249 @@ func (k *Kobo) HandleUCExit(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// WebSend is a small function to print a message to webclient, and wait for to be sent before returning
+// HandleLibrary lists the books on the device. The list can be filtered with the 'search'
+// parameter, sorted with the 'sort' and 'order' parameters, and is split into pages
+// so the e-ink display only has to render a handful of books at a time.
+func (k *Kobo) HandleLibrary(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	search := strings.ToLower(strings.TrimSpace(q.Get("search")))
+	page, _ := strconv.Atoi(q.Get("page"))
+	perPage, _ := strconv.Atoi(q.Get("perPage"))
+	if perPage <= 0 || perPage > 100 {
+		perPage = 10
+	}
+	// The library can be browsed before connecting to Calibre, in which case the metadata
+	// might not have been loaded yet
+	if err := k.loadMetadata(); err != nil {
+		http.Error(w, "error loading library metadata", http.StatusInternalServerError)
+		return
+	}
+	books := make([]libraryBook, 0)
+	err := k.EachMetadata(func(cid string, md uc.CalibreBookMeta) {
+		lb := libraryBook{ContentID: cid, Title: md.Title, Authors: md.Authors, Size: md.Size, titleSort: md.TitleSort, authorSort: md.AuthorSort}
+		if md.Series != nil {
+			lb.Series = *md.Series
+		}
+		if md.SeriesIndex != nil {
+			lb.SeriesIndex = *md.SeriesIndex
+		}
+		_, lb.MarkedDelete = k.deleteQueue[cid]
+		if search != "" && !lb.matches(search) {
+			return
+		}
+		books = append(books, lb)
+	})
+	if err != nil {
+		kulog.Err(err)
+		http.Error(w, "error reading library metadata", http.StatusInternalServerError)
+		return
+	}
+	sortLibraryBooks(books, q.Get("sort"), q.Get("order") == "desc")
+
+	res := libraryPage{Total: len(books), PerPage: perPage}
+	if maxPage := (len(books) - 1) / perPage; page > maxPage {
+		page = maxPage
+	}
+	if page < 0 {
+		page = 0
+	}
+	res.Page = page
+	start, end := page*perPage, (page+1)*perPage
+	if end > len(books) {
+		end = len(books)
+	}
+	res.Books = books[start:end]
+	k.rend.JSON(w, http.StatusOK, res)
+}
+
+func (lb *libraryBook) matches(search string) bool {
+	if strings.Contains(strings.ToLower(lb.Title), search) || strings.Contains(strings.ToLower(lb.Series), search) {
+		return true
+	}
+	for _, a := range lb.Authors {
+		if strings.Contains(strings.ToLower(a), search) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortLibraryBooks(books []libraryBook, sortBy string, desc bool) {
+	titleKey := func(lb *libraryBook) string {
+		if lb.titleSort != "" {
+			return strings.ToLower(lb.titleSort)
+		}
+		return strings.ToLower(lb.Title)
+	}
+	authorKey := func(lb *libraryBook) string {
+		if lb.authorSort != "" {
+			return strings.ToLower(lb.authorSort)
+		}
+		return strings.ToLower(strings.Join(lb.Authors, " & "))
+	}
+	less := func(i, j int) bool {
+		a, b := &books[i], &books[j]
+		switch sortBy {
+		case "author":
+			if authorKey(a) != authorKey(b) {
+				return authorKey(a) < authorKey(b)
+			}
+		case "series":
+			if strings.ToLower(a.Series) != strings.ToLower(b.Series) {
+				// Books without a series go last
+				if a.Series == "" || b.Series == "" {
+					return b.Series == ""
+				}
+				return strings.ToLower(a.Series) < strings.ToLower(b.Series)
+			}
+			if a.SeriesIndex != b.SeriesIndex {
+				return a.SeriesIndex < b.SeriesIndex
+			}
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		}
+		return titleKey(a) < titleKey(b)
+	}
+	sort.SliceStable(books, func(i, j int) bool {
+		if desc {
+			return less(j, i)
+		}
+		return less(i, j)
+	})
+}
+
+// HandleLibraryCover serves the library thumbnail of the book identified by the 'cid' parameter
+func (k *Kobo) HandleLibraryCover(w http.ResponseWriter, r *http.Request) {
+	cid := r.URL.Query().Get("cid")
+	// Only serve covers for books we know about. This also ensures the client can't
+	// use the cid to go looking elsewhere on the filesystem.
+	if !k.HasMetadata(cid) {
+		http.NotFound(w, r)
+		return
+	}
+	imgID := kobo.ContentIDToImageID(cid)
+	http.ServeFile(w, r, filepath.Join(k.BKRootDir, kobo.CoverTypeLibGrid.GeneratePath(k.UseSDCard, imgID)))
+}
+
+// HandleLibraryDelete marks or unmarks a book for deletion
+func (k *Kobo) HandleLibraryDelete(w http.ResponseWriter, r *http.Request) {
+	var ld libraryDelete
+	if err := json.NewDecoder(r.Body).Decode(&ld); err != nil {
+		http.Error(w, "error getting book to delete from client", http.StatusBadRequest)
+		return
+	}
+	if err := k.MarkForDeletion(ld.ContentID, ld.Marked); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// WebSend sends a message to any connected web clients. It never blocks, and
+// messages sent while no client is connected are replayed when one connects.
 func (k *Kobo) WebSend(msg WebMsg) {
-	k.MsgChan <- msg
-	<-k.doneChan
+	k.publishWebMsg(msg)
+}
+
+// publishWebMsg converts msg into events for the web UI, and returns the ID of the last event published
+func (k *Kobo) publishWebMsg(msg WebMsg) uint64 {
+	var id uint64
+	switch {
+	case msg.Transfer != nil:
+		id = k.events.publish("transferProgress", msg.Transfer)
+	case msg.Error != nil:
+		id = k.events.publish("itemError", msg.Error)
+	case msg.GetPassword:
+		k.dialogMux.Lock()
+		if k.pendingAuth != nil {
+			// Never send the password itself to the browser
+			k.events.publishSticky("auth", authEvent{LibName: k.pendingAuth.LibName, Attempts: k.pendingAuth.Attempts})
+		}
+		k.dialogMux.Unlock()
+	case msg.GetCalInstance:
+		k.dialogMux.Lock()
+		k.events.publishSticky("calibreInstances", instancesEvent{Instances: k.calInstances})
+		k.dialogMux.Unlock()
+	case msg.GetLibInfo:
+		// The library info stays valid for the whole session, so new clients always need it
+		k.events.publishSticky("libInfo", k.libraryOptions())
+	case msg.Finished != "":
+		id = k.events.publish("kuFinished", finishedEvent{Message: msg.Finished, Summary: msg.Summary})
+	default:
+		if msg.ShowMessage != "" {
+			id = k.events.publish("showMessage", messageEvent{Message: msg.ShowMessage})
+		}
+		if msg.Progress != IgnoreProgress {
+			id = k.events.publish("progress", progressEvent{Percent: msg.Progress})
+		}
+	}
+	return id
+}
+
+// HandleDiagnostics sends information useful for debugging problems, including the
+// session history and recent log lines
+func (k *Kobo) HandleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	diag := diagnostics{
+		KUVersion:   k.KuVers,
+		DeviceModel: k.Device.String(),
+		Firmware:    string(k.fw),
+		StorageType: k.webInfo.StorageType,
+		Config:      k.config(),
+		RecentLog:   k.recentLog.Lines(),
+	}
+	var err error
+	if diag.FreeSpace, err = k.FreeSpace(); err != nil {
+		diag.FreeSpaceError = err.Error()
+	}
+	if diag.Sessions, err = readSessionHistory(filepath.Join(k.DBRootDir, kuSessionHistory)); err != nil {
+		kulog.Err(err)
+	}
+	k.rend.JSON(w, http.StatusOK, diag)
+}
+
+// HandleVerifyLibrary checks every book on the device for missing or corrupt files
+func (k *Kobo) HandleVerifyLibrary(w http.ResponseWriter, r *http.Request) {
+	problems, err := k.VerifyLibrary()
+	if err != nil {
+		kulog.Err(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	k.rend.JSON(w, http.StatusOK, problems)
+}
+
+// HandleStorage lists the sideloaded books on each storage
+func (k *Kobo) HandleStorage(w http.ResponseWriter, r *http.Request) {
+	info, err := k.StorageBooks()
+	if err != nil {
+		kulog.Err(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	k.rend.JSON(w, http.StatusOK, info)
+}
+
+// HandleMigrate moves books between storages. If no content IDs are given, every book on
+// the other storage is moved.
+func (k *Kobo) HandleMigrate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		To         string   `json:"to"`
+		ContentIDs []string `json:"contentIDs"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "error decoding migration request", http.StatusBadRequest)
+		return
+	}
+	res, err := k.MigrateBooks(req.To, req.ContentIDs)
+	if errors.Is(err, ErrSessionStarted) {
+		http.Error(w, "Books can't be moved once KU has been started", http.StatusConflict)
+		return
+	} else if err != nil {
+		kulog.Err(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	k.rend.JSON(w, http.StatusOK, res)
 }
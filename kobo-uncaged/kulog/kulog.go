@@ -0,0 +1,168 @@
+// Copyright 2019-2020 Sherman Perry
+
+// This file is part of Kobo UNCaGED.
+
+// Kobo UNCaGED is free software: you can redistribute it and/or modify
+// it under the terms of the Affero GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Kobo UNCaGED is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with Kobo UNCaGED.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package kulog provides leveled logging for Kobo UNCaGED. Messages are written
+// through the standard log package, so anything logged by our dependencies ends
+// up in the same places, with the same redaction applied.
+package kulog
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Level is the severity of a log message
+type Level int
+
+// Log levels, in increasing order of severity
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+func (l Level) String() string {
+	switch l {
+	case Debug:
+		return "DEBUG"
+	case Info:
+		return "INFO"
+	case Warn:
+		return "WARN"
+	case Error:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+const redacted = "[REDACTED]"
+
+// passwordRegex catches passwords logged as key/value pairs, in case
+// they were never registered with Redact
+var passwordRegex = regexp.MustCompile(`(?i)("?password"?\s*[:=]\s*)("[^"]*"|\S+)`)
+
+// logger fans log output out to multiple writers, redacting secrets first
+type logger struct {
+	mux      sync.Mutex
+	minLevel Level
+	outputs  []io.Writer
+	secrets  []string
+}
+
+var std = &logger{minLevel: Info}
+
+func (l *logger) Write(p []byte) (int, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	msg := passwordRegex.ReplaceAllString(string(p), "${1}"+redacted)
+	for _, s := range l.secrets {
+		msg = strings.ReplaceAll(msg, s, redacted)
+	}
+	for _, w := range l.outputs {
+		// A failing output (eg: a full disk) shouldn't stop the others
+		w.Write([]byte(msg))
+	}
+	return len(p), nil
+}
+
+// Init sends all output from the standard logger through kulog, to the provided writers
+func Init(outputs ...io.Writer) {
+	std.mux.Lock()
+	std.outputs = append([]io.Writer(nil), outputs...)
+	std.mux.Unlock()
+	log.SetOutput(std)
+}
+
+// AddOutput adds another writer that log messages will be written to
+func AddOutput(w io.Writer) {
+	std.mux.Lock()
+	defer std.mux.Unlock()
+	std.outputs = append(std.outputs, w)
+}
+
+// SetDebug enables or disables debug messages
+func SetDebug(enabled bool) {
+	std.mux.Lock()
+	defer std.mux.Unlock()
+	std.minLevel = Info
+	if enabled {
+		std.minLevel = Debug
+	}
+}
+
+// DebugEnabled reports whether debug messages are being logged
+func DebugEnabled() bool {
+	std.mux.Lock()
+	defer std.mux.Unlock()
+	return std.minLevel <= Debug
+}
+
+// Redact registers a secret (such as a password) that must never be written to the log
+func Redact(secret string) {
+	if secret == "" {
+		return
+	}
+	std.mux.Lock()
+	defer std.mux.Unlock()
+	for _, s := range std.secrets {
+		if s == secret {
+			return
+		}
+	}
+	std.secrets = append(std.secrets, secret)
+}
+
+// Logf logs a message at the given level
+func Logf(level Level, format string, a ...interface{}) {
+	std.mux.Lock()
+	skip := level < std.minLevel
+	std.mux.Unlock()
+	if skip {
+		return
+	}
+	log.Printf("[%s] %s", level, fmt.Sprintf(format, a...))
+}
+
+// Debugf logs a debug message, if debug logging is enabled
+func Debugf(format string, a ...interface{}) {
+	Logf(Debug, format, a...)
+}
+
+// Infof logs an informational message
+func Infof(format string, a ...interface{}) {
+	Logf(Info, format, a...)
+}
+
+// Warnf logs a warning
+func Warnf(format string, a ...interface{}) {
+	Logf(Warn, format, a...)
+}
+
+// Errorf logs an error
+func Errorf(format string, a ...interface{}) {
+	Logf(Error, format, a...)
+}
+
+// Err logs err at the error level
+func Err(err error) {
+	Logf(Error, "%v", err)
+}
@@ -0,0 +1,85 @@
+package kulog
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	Init(&buf)
+	Redact("hunter2")
+	Infof("got password hunter2 from the user")
+	Infof(`{"password": "s3cret", "user": "bob"}`)
+	SetDebug(false)
+	Debugf("not logged")
+	out := buf.String()
+	for _, s := range []string{"hunter2", "s3cret", "not logged"} {
+		if strings.Contains(out, s) {
+			t.Errorf("log output contains %q: %s", s, out)
+		}
+	}
+	if !strings.Contains(out, "[INFO]") || !strings.Contains(out, "bob") {
+		t.Errorf("log output missing expected text: %s", out)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ku-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rf, err := OpenRotatingFile(dir, "ku.log", 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for fn, want := range map[string]string{"ku.log": "fourth\n", "ku.log.1": "third\n", "ku.log.2": "second\n"} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", fn, got, want)
+		}
+	}
+}
+
+func TestRotatingFileFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ku-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A non-empty directory where the old log should go makes the rotation fail
+	if err = os.MkdirAll(filepath.Join(dir, "ku.log.1", "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	rf, err := OpenRotatingFile(dir, "ku.log", 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "ku.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(got), "error rotating log") || !strings.HasSuffix(string(got), "third\n") {
+		t.Errorf("ku.log = %q", got)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2019-2020 Sherman Perry
+
+// This file is part of Kobo UNCaGED.
+
+// Kobo UNCaGED is free software: you can redistribute it and/or modify
+// it under the terms of the Affero GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Kobo UNCaGED is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with Kobo UNCaGED.  If not, see <https://www.gnu.org/licenses/>.
+
+package kulog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// RotatingFile is an io.Writer that writes to a log file, moving it aside once it
+// reaches maxSize. Up to maxFiles old logs are kept as name.1, name.2 etc, with
+// name.1 being the most recent.
+type RotatingFile struct {
+	mux      sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+// OpenRotatingFile opens (or creates) the log file name in dir for appending
+func OpenRotatingFile(dir, name string, maxSize int64, maxFiles int) (*RotatingFile, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("OpenRotatingFile: error creating log directory: %w", err)
+	}
+	rf := &RotatingFile{path: filepath.Join(dir, name), maxSize: maxSize, maxFiles: maxFiles}
+	if err := rf.open(); err != nil {
+		return nil, fmt.Errorf("OpenRotatingFile: %w", err)
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, fi.Size()
+	return nil
+}
+
+// rotate moves the log file aside and starts a new one. If that fails, the log file is
+// reopened, so logging can continue, and the error is returned.
+func (rf *RotatingFile) rotate() error {
+	err := rf.f.Close()
+	rf.f = nil
+	if err == nil {
+		err = rf.shift()
+	}
+	if oerr := rf.open(); oerr != nil {
+		if err != nil {
+			return fmt.Errorf("%v, and reopening the log failed: %w", err, oerr)
+		}
+		return oerr
+	}
+	return err
+}
+
+// shift renames the log file and the old logs, removing the oldest
+func (rf *RotatingFile) shift() error {
+	for i := rf.maxFiles - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if rf.maxFiles > 0 {
+		return os.Rename(rf.path, rf.path+".1")
+	}
+	return os.Remove(rf.path)
+}
+
+// Write writes p to the log file, rotating it first if required
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mux.Lock()
+	defer rf.mux.Unlock()
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			if rf.f == nil {
+				return 0, fmt.Errorf("RotatingFile: error rotating log: %w", err)
+			}
+			// Keep writing to the current log, and try again once another maxSize
+			// bytes have been written. The error is recorded in the log itself, as
+			// that is the only place it will be seen.
+			rf.size = 0
+			msg := fmt.Sprintf("kulog: error rotating log: %v\n", err)
+			n, _ := rf.f.WriteString(msg)
+			rf.size += int64(n)
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Close closes the log file
+func (rf *RotatingFile) Close() error {
+	rf.mux.Lock()
+	defer rf.mux.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
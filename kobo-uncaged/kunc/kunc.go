@@ -18,17 +18,18 @@
 package kunc
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"image"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/device"
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/kulog"
 	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/util"
 	"github.com/shermp/UNCaGED/uc"
 )
@@ -67,8 +68,7 @@ func (ku *koboUncaged) GetClientOptions() (uc.ClientOptions, error) {
 // A nil slice is interpreted has having no books on the device
 func (ku *koboUncaged) GetDeviceBookList() ([]uc.BookCountDetails, error) {
 	bc := []uc.BookCountDetails{}
-	for k, md := range ku.k.MetadataMap {
-		fmt.Println(k)
+	err := ku.k.EachMetadata(func(_ string, md uc.CalibreBookMeta) {
 		lastMod := time.Now()
 		if md.LastModified.GetTime() != nil {
 			lastMod = *md.LastModified.GetTime()
@@ -80,6 +80,9 @@ func (ku *koboUncaged) GetDeviceBookList() ([]uc.BookCountDetails, error) {
 		}
 		bcd.Extension = filepath.Ext(md.Lpath)
 		bc = append(bc, bcd)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetDeviceBookList: %w", err)
 	}
 	return bc, nil
 }
@@ -92,9 +95,11 @@ func (ku *koboUncaged) GetMetadataIter(books []uc.BookID) uc.MetadataIter {
 			iter.Add(cid)
 		}
 	} else {
-		for cid := range ku.k.MetadataMap {
+		// Only the ContentIDs are gathered here. The metadata of each book is read as
+		// the iterator reaches it.
+		ku.k.EachMetadata(func(cid string, _ uc.CalibreBookMeta) {
 			iter.Add(cid)
-		}
+		})
 	}
 	return iter
 }
@@ -113,7 +118,7 @@ func (ku *koboUncaged) SetDeviceInfo(devInfo uc.DeviceInfo) error {
 }
 
 func (ku *koboUncaged) SetLibraryInfo(libInfo uc.CalibreLibraryInfo) error {
-	ku.k.LibInfo = libInfo
+	ku.k.SetLibraryInfo(libInfo)
 	ku.k.WebSend(device.WebMsg{GetLibInfo: true})
 	return nil
 }
@@ -123,11 +128,15 @@ func (ku *koboUncaged) SetLibraryInfo(libInfo uc.CalibreLibraryInfo) error {
 func (ku *koboUncaged) UpdateMetadata(mdList []uc.CalibreBookMeta) error {
 	for _, md := range mdList {
 		md.Thumbnail = nil
+		md.Lpath = ku.k.ResolveLpath(md.Lpath)
 		cid := util.LpathToContentID(md.Lpath, string(ku.k.ContentIDprefix))
-		ku.k.MetadataMap[cid] = md
-		ku.k.UpdatedMetadata[cid] = struct{}{}
+		if err := ku.k.SetMetadata(cid, md); err != nil {
+			return fmt.Errorf("UpdateMetadata: %w", err)
+		}
+		ku.k.MarkMetadataUpdated(cid)
 	}
-	ku.k.WriteMDfile()
+	ku.k.Session.MetadataUpdated(len(mdList))
+	ku.k.ScheduleMDwrite()
 	return nil
 }
 
@@ -139,16 +148,18 @@ func (ku *koboUncaged) GetPassword(calibreInfo uc.CalibreInitInfo) (string, erro
 
 // GetFreeSpace reports the amount of free storage space to Calibre
 func (ku *koboUncaged) GetFreeSpace() uint64 {
-	// Note, this method of getting available disk space is Linux specific...
-	// Don't try to run this code on Windows. It will probably fall over
-	var fs syscall.Statfs_t
-	err := syscall.Statfs(ku.k.BKRootDir, &fs)
+	free, err := ku.k.FreeSpace()
 	if err != nil {
-		log.Println(err)
-		// Despite the error, we return an arbitrary amount. Thoughts on this?
-		return 1024 * 1024 * 1024
+		// Report no free space, rather than guessing and risking filling the disk
+		kulog.Err(err)
+		ku.k.Session.AddError("Free space", err)
+		return 0
 	}
-	return fs.Bavail * uint64(fs.Bsize)
+	// Keep some space free for Nickel's database and covers
+	if reserved := ku.k.ReservedSpace(); free > reserved {
+		return free - reserved
+	}
+	return 0
 }
 
 // CheckLpath asks the client to verify a provided Lpath, and change it if required
@@ -156,11 +167,11 @@ func (ku *koboUncaged) GetFreeSpace() uint64 {
 func (ku *koboUncaged) CheckLpath(lpath string) (newLpath string) {
 	// The calibre wireless driver does not sanitize the filepath for us. We sanitize it here,
 	// and if lpath changes, inform Calibre of the new lpath.
-	newLpath = util.SanitizeFilepath(lpath)
 	// Also, for kepub files, Calibre defaults to using "book/path.kepub"
 	// but we require "book/path.kepub.epub". We change that here if needed.
-	newLpath = util.LpathKepubConvert(newLpath)
-	return newLpath
+	// Finally, a different book must not be overwritten, which is easy to do
+	// on a case insensitive filesystem.
+	return ku.k.CheckLpath(lpath)
 }
 
 // SaveBook saves a book with the provided metadata to the disk.
@@ -169,19 +180,50 @@ func (ku *koboUncaged) CheckLpath(lpath string) (newLpath string) {
 // newLpath informs UNCaGED of an Lpath change. Use this if the lpath field in md is
 // not valid (eg filesystem limitations.). Return an empty string if original lpath is valid
 func (ku *koboUncaged) SaveBook(md uc.CalibreBookMeta, book io.Reader, len int, lastBook bool) (err error) {
+	var requestedLpath string
+	calLpath := md.Lpath
+	md.Lpath, requestedLpath, err = ku.k.BookLpath(&md)
+	if err != nil {
+		ku.k.Session.AddError(calLpath, err)
+		return fmt.Errorf("SaveBook: refusing to save '%s': %w", md.Title, err)
+	}
 	cID := util.LpathToContentID(md.Lpath, string(ku.k.ContentIDprefix))
 	bkPath := util.ContentIDtoBkPath(ku.k.BKRootDir, cID, string(ku.k.ContentIDprefix))
 	bkDir, _ := filepath.Split(bkPath)
+	replaced := ku.k.HasMetadata(cID)
+	defer func() {
+		if err != nil {
+			ku.k.Session.AddError(md.Lpath, err)
+		} else {
+			ku.k.Session.BookReceived(len, replaced)
+		}
+	}()
+	if err = ku.k.CheckSpaceFor(int64(len)); err != nil {
+		return fmt.Errorf("SaveBook: refusing to save '%s': %w", md.Title, err)
+	}
 	err = os.MkdirAll(bkDir, 0777)
 	if err != nil {
 		return fmt.Errorf("SaveBook: error making book directories: %w", err)
 	}
-	destBook, err := os.Create(bkPath)
+	// Write to a temporary file, so that an existing copy of the book is kept until
+	// the new copy has been received in full
+	partPath := device.PartPath(bkPath)
+	destBook, err := os.Create(partPath)
 	if err != nil {
 		return fmt.Errorf("SaveBook: error opening ebook file: %w", err)
 	}
 	defer destBook.Close()
-	ku.k.UpdatedMetadata[cID] = struct{}{}
+	if jErr := ku.k.JournalStart(cID); jErr != nil {
+		kulog.Warnf("%v", jErr)
+	}
+	defer func() {
+		if err != nil {
+			// Don't leave a partial book around
+			destBook.Close()
+			os.Remove(partPath)
+			ku.k.JournalAbort(cID)
+		}
+	}()
 	ku.k.WebSend(device.WebMsg{ShowMessage: fmt.Sprintf("Transferring: %s - %s", strings.Join(md.Authors, " "), md.Title),
 		Progress: device.IgnoreProgress})
 	// We don't need to save the calibre cover path in metadata.calibre
@@ -198,21 +240,63 @@ func (ku *koboUncaged) SaveBook(md uc.CalibreBookMeta, book io.Reader, len int,
 		// above goroutine is finished with it
 		md.Thumbnail = nil
 	}
-	if _, err = io.CopyN(destBook, book, int64(len)); err != nil {
+	pr := newProgressReader(book, int64(len), func(read int64, rate, eta float64) {
+		booksDone, sessionBytes := ku.k.Session.Received()
+		ku.k.WebSend(device.WebMsg{Transfer: &device.TransferProgress{
+			Title:         md.Title,
+			BookBytes:     read,
+			BookSize:      int64(len),
+			BooksReceived: booksDone,
+			SessionBytes:  sessionBytes + read,
+			Rate:          rate,
+			ETASecs:       eta,
+		}})
+	})
+	h := sha256.New()
+	if _, err = io.CopyN(io.MultiWriter(destBook, h), pr, int64(len)); err != nil {
 		return fmt.Errorf("SaveBook: error writing ebook to file: %w", err)
 	}
+	if err = destBook.Close(); err != nil {
+		return fmt.Errorf("SaveBook: error closing ebook file: %w", err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if err = ku.k.VerifyBookFile(partPath, bkPath, int64(len), sum); err != nil {
+		return fmt.Errorf("SaveBook: '%s' failed verification: %w", md.Title, err)
+	}
+	if replaced {
+		// Not fatal, the copy is about to be replaced, but the user should know their
+		// storage may be failing
+		if vErr := ku.k.VerifyStoredBook(cID); vErr != nil {
+			kulog.Warnf("SaveBook: previous copy of '%s' was damaged: %v", md.Title, vErr)
+		}
+	}
+	if err = os.Rename(partPath, bkPath); err != nil {
+		return fmt.Errorf("SaveBook: error moving received book into place: %w", err)
+	}
+	ku.k.SetBookInfo(cID, int64(len), sum, requestedLpath)
+	ku.k.MarkMetadataUpdated(cID)
 	ku.k.UpdateIfExists(cID, len)
-	ku.k.MetadataMap[cID] = md
+	// The metadata must be set before the book is marked complete in the journal, in case
+	// a scheduled write clears the journal in between
+	if err = ku.k.SetMetadata(cID, md); err != nil {
+		return fmt.Errorf("SaveBook: %w", err)
+	}
+	if jErr := ku.k.JournalComplete(cID, md); jErr != nil {
+		// Not fatal, the book will just be sent again if the connection drops
+		kulog.Warnf("%v", jErr)
+	}
 	if lastBook {
-		ku.k.WriteMDfile()
+		ku.k.ScheduleMDwrite()
 	}
 	return err
 }
 
-// GetBook provides an io.ReadCloser, and the file len, from which UNCaGED can send the requested book to Calibre
+// GetBook provides an io.ReadCloser, and the remaining file len, from which UNCaGED can send the
+// requested book to Calibre, starting at filePos.
 // NOTE: filePos > 0 is not currently implemented in the Calibre source code, but that could
 // change at any time, so best to handle it anyway.
 func (ku *koboUncaged) GetBook(book uc.BookID, filePos int64) (io.ReadCloser, int64, error) {
+	book.Lpath = ku.k.ResolveLpath(book.Lpath)
 	cid := util.LpathToContentID(book.Lpath, string(ku.k.ContentIDprefix))
 	bkPath := util.ContentIDtoBkPath(ku.k.BKRootDir, cid, string(ku.k.ContentIDprefix))
 	fi, err := os.Stat(bkPath)
@@ -220,48 +304,57 @@ func (ku *koboUncaged) GetBook(book uc.BookID, filePos int64) (io.ReadCloser, in
 		return nil, 0, fmt.Errorf("GetBook: error getting book stats: %w", err)
 	}
 	bookLen := fi.Size()
+	if filePos < 0 || filePos > bookLen {
+		return nil, 0, fmt.Errorf("GetBook: invalid file position %d for book of %d bytes", filePos, bookLen)
+	}
 	ebook, err := os.OpenFile(bkPath, os.O_RDONLY, 0644)
 	if err != nil {
 		err = fmt.Errorf("GetBook: error opening book file: %w", err)
+		ku.k.Session.AddError(book.Lpath, err)
+		return nil, 0, err
 	}
-	return ebook, bookLen, err
+	// Calibre may ask for the rest of a book, if a previous attempt was interrupted
+	if _, err = ebook.Seek(filePos, io.SeekStart); err != nil {
+		ebook.Close()
+		return nil, 0, fmt.Errorf("GetBook: error seeking to file position %d: %w", filePos, err)
+	}
+	return &sentBook{ReadCloser: ebook, session: ku.k.Session}, bookLen - filePos, nil
+}
+
+// sentBook counts the bytes UNCaGED reads from a book, so the session log
+// records what was actually sent to Calibre
+type sentBook struct {
+	io.ReadCloser
+	session *device.SessionLog
+	sent    int64
+}
+
+func (sb *sentBook) Read(p []byte) (int, error) {
+	n, err := sb.ReadCloser.Read(p)
+	sb.sent += int64(n)
+	return n, err
+}
+
+func (sb *sentBook) Close() error {
+	sb.session.BookSent(sb.sent)
+	return sb.ReadCloser.Close()
 }
 
 // DeleteBook instructs the client to delete the specified book on the device
 // Error is returned if the book was unable to be deleted
 func (ku *koboUncaged) DeleteBook(book uc.BookID) error {
 	var err error
-	// Start with basic book deletion. A more fancy implementation can come later
-	// (eg: removing cover image remnants etc)
+	book.Lpath = ku.k.ResolveLpath(book.Lpath)
 	cid := util.LpathToContentID(book.Lpath, string(ku.k.ContentIDprefix))
 	bkPath := util.ContentIDtoBkPath(ku.k.BKRootDir, cid, string(ku.k.ContentIDprefix))
-	dir, _ := filepath.Split(bkPath)
-	dirPath := filepath.Clean(dir)
-	if ku.k.KuConfig.EnableDebug {
-		log.Printf("[DEBUG] CID: %s, bkPath: %s, dir: %s, dirPath: %s\n", cid, bkPath, dir, dirPath)
-	}
 	ku.k.WebSend(device.WebMsg{ShowMessage: fmt.Sprintf("Deleting: %s", bkPath), Progress: device.IgnoreProgress})
-	if err = os.Remove(bkPath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("DeleteBook: error deleting file: %w", err)
-	}
-	for dirPath != filepath.Clean(ku.k.BKRootDir) {
-		// Note, os.Remove only removes empty directories, so it should be safe to call
-		if err = os.Remove(dirPath); err != nil {
-			// We don't consider failure to remove parent directories an error, so
-			// long as the book file itself was deleted.
-			break
-		}
-		// Walk 'up' the path
-		dirPath = filepath.Clean(filepath.Join(dirPath, "../"))
-	}
-	// Now we remove the book from the metadata map
-	delete(ku.k.MetadataMap, cid)
-	// As well as the updated metadata list, if it was added to the list this session
-	delete(ku.k.UpdatedMetadata, cid)
-	// Finally, write the new metadata files
-	if err = ku.k.WriteMDfile(); err != nil {
-		return fmt.Errorf("DeleteBook: error writing metadata file: %w", err)
+	if err = ku.k.RemoveBook(cid); err != nil {
+		ku.k.Session.AddError(book.Lpath, err)
+		return fmt.Errorf("DeleteBook: %w", err)
 	}
+	ku.k.Session.BookDeleted()
+	// Calibre deletes books one at a time, so the metadata is written once it is done
+	ku.k.ScheduleMDwrite()
 	return nil
 }
 
@@ -312,9 +405,56 @@ func (ku *koboUncaged) UpdateStatus(status uc.Status, progress int) {
 
 // LogPrintf instructs the client to log informational and debug info, that aren't errors
 func (ku *koboUncaged) LogPrintf(logLevel uc.LogLevel, format string, a ...interface{}) {
-	log.Printf(format, a...)
+	level := kulog.Info
+	switch logLevel {
+	case uc.Warn:
+		level = kulog.Warn
+	case uc.Debug:
+		level = kulog.Debug
+	}
+	kulog.Logf(level, format, a...)
 }
 
 func (ku *koboUncaged) SetExitChannel(exitChan chan<- bool) {
 	ku.k.UCExitChan = exitChan
 }
+
+// progressInterval is the minimum time between transfer progress updates
+const progressInterval = 500 * time.Millisecond
+
+// progressReader reports how much of a book has been read, along with the transfer
+// rate and estimated time remaining. Updates are throttled to progressInterval, but
+// the final update is always sent.
+type progressReader struct {
+	r        io.Reader
+	size     int64
+	read     int64
+	start    time.Time
+	lastSent time.Time
+	report   func(read int64, rate, eta float64)
+}
+
+func newProgressReader(r io.Reader, size int64, report func(read int64, rate, eta float64)) *progressReader {
+	now := time.Now()
+	pr := &progressReader{r: r, size: size, start: now, lastSent: now, report: report}
+	report(0, 0, 0)
+	return pr
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.read += int64(n)
+	now := time.Now()
+	if pr.read >= pr.size || now.Sub(pr.lastSent) >= progressInterval {
+		pr.lastSent = now
+		var rate, eta float64
+		if elapsed := now.Sub(pr.start).Seconds(); elapsed > 0 {
+			rate = float64(pr.read) / elapsed
+		}
+		if rate > 0 {
+			eta = float64(pr.size-pr.read) / rate
+		}
+		pr.report(pr.read, rate, eta)
+	}
+	return n, err
+}
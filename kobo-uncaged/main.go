@@ -20,12 +20,14 @@ package main
 import (
 	"errors"
 	"flag"
-	"log"
+	"io"
 	"log/syslog"
 	"os"
+	"path/filepath"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/device"
+	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/kulog"
 	"github.com/shermp/Kobo-UNCaGED/kobo-uncaged/kunc"
 	"github.com/shermp/UNCaGED/uc"
 )
@@ -35,6 +37,12 @@ type returnCode int
 // Note, this is set by the go linker at build time
 var kuVersion string
 
+// Log files are kept on the onboard storage, so users can copy them over USB
+const kuLogDir = ".adds/kobo-uncaged/logs"
+const kuLogName = "ku.log"
+const kuLogMaxSize = 1024 * 1024
+const kuLogMaxFiles = 3
+
 const (
 	genericError     returnCode = 250
 	succsess         returnCode = 0
@@ -46,12 +54,15 @@ const (
 func returncodeFromError(err error, k *device.Kobo) returnCode {
 	rc := succsess
 	if err != nil {
-		log.Print(err)
+		kulog.Err(err)
 		if k == nil {
 			return genericError
 		}
 		k.FinishedMsg = err.Error()
 		rc = genericError
+		if errors.Is(err, device.ErrInsufficientSpace) {
+			k.FinishedMsg = "Not enough free space on your Kobo!<br>Some books were not received"
+		}
 		var calErr uc.CalError
 		if errors.As(err, &calErr) {
 			switch calErr {
@@ -70,53 +81,67 @@ func returncodeFromError(err error, k *device.Kobo) returnCode {
 	return rc
 }
 func mainWithErrCode() returnCode {
-	w, err := syslog.New(syslog.LOG_DEBUG, "KoboUNCaGED")
-	if err == nil {
-		log.SetOutput(w)
+	var logOutputs []io.Writer
+	if w, err := syslog.New(syslog.LOG_DEBUG, "KoboUNCaGED"); err == nil {
+		logOutputs = append(logOutputs, w)
+	} else {
+		logOutputs = append(logOutputs, os.Stderr)
 	}
+	kulog.Init(logOutputs...)
 	onboardMntPtr := flag.String("onboardmount", "/mnt/onboard", "If changed, specify the new new mountpoint of '/mnt/onboard'")
 	sdMntPtr := flag.String("sdmount", "", "If changed, specify the new new mountpoint of '/mnt/sd'")
 	bindAddrPtr := flag.String("bindaddr", "127.0.0.1:8181", "Specify the network address and port <IP:POrt> to listen on")
+	allowRemotePtr := flag.Bool("allowremote", false, "Allow listening on a non-loopback address. Every request still requires the session token")
 	disableNDBPtr := flag.Bool("disablendb", false, "Disables use of NickelDBus. Useful for desktop testing")
 
 	flag.Parse()
-	log.Println("Started Kobo-UNCaGED")
-	log.Println("Reading options")
-	log.Println("Creating KU object")
-	k, err := device.New(*onboardMntPtr, *sdMntPtr, *bindAddrPtr, *disableNDBPtr, kuVersion)
+	if lf, err := kulog.OpenRotatingFile(filepath.Join(*onboardMntPtr, kuLogDir), kuLogName, kuLogMaxSize, kuLogMaxFiles); err == nil {
+		kulog.AddOutput(lf)
+		defer lf.Close()
+	} else {
+		kulog.Err(err)
+	}
+	kulog.Infof("Started Kobo-UNCaGED")
+	kulog.Infof("Reading options")
+	kulog.Infof("Creating KU object")
+	k, err := device.New(*onboardMntPtr, *sdMntPtr, *bindAddrPtr, *allowRemotePtr, *disableNDBPtr, kuVersion)
 	if err != nil {
-		log.Print(err)
+		kulog.Err(err)
 		return returncodeFromError(err, nil)
 	} else if k == nil {
 		return successEarlyExit // the user exited during config
 	}
 	defer k.Close()
 
-	log.Println("Preparing Kobo UNCaGED!")
+	kulog.Infof("Preparing Kobo UNCaGED!")
 	ku := kunc.New(k)
 	cc, err := uc.New(ku, k.KuConfig.EnableDebug)
 	if err != nil {
-		log.Print(err)
+		kulog.Err(err)
 		return returncodeFromError(err, k)
 	}
-	log.Println("Starting Calibre Connection")
+	kulog.Infof("Starting Calibre Connection")
 	err = cc.Start()
 	if err != nil {
-		log.Print(err)
+		kulog.Err(err)
 		return returncodeFromError(err, k)
 	}
+	if err = k.ProcessDeleteQueue(); err != nil {
+		// The remaining books will still be marked in the web UI next time
+		kulog.Err(err)
+	}
 	if err = k.WritePassCache(); err != nil {
 		// Not fatal, just log it
-		log.Print(err)
+		kulog.Err(err)
 	}
 	if err = k.SaveUserOptions(); err != nil {
 		// Annoying, but not fatal
-		log.Print(err)
+		kulog.Err(err)
 	}
 	if len(k.UpdatedMetadata) > 0 {
 		if err := k.WriteUpdatedMetadataSQL(); err != nil {
 			k.FinishedMsg = "Updating metadata failed"
-			log.Print(err)
+			kulog.Err(err)
 			return returncodeFromError(err, k)
 		}
 		k.FinishedMsg = "Calibre disconnected<br>Metadata will be updated"
@@ -18,16 +18,24 @@ function setKoboSizes(dpi) {
     containerDiv.style.margin = 'auto';
 }
 
+// Every request to KU must carry the session token
+function newKUxhr(method, path) {
+    var xhr = new XMLHttpRequest();
+    xhr.open(method, path);
+    xhr.setRequestHeader('X-KU-Token', kuInfo.authToken);
+    return xhr;
+}
+
 // Abstract away the AJAX GET boilerplate
 function getKUJson(path, responseHandler) {
-    var xhr = new XMLHttpRequest();
-    xhr.open('GET', path);
+    var xhr = newKUxhr('GET', path);
     xhr.onload = function() {
         responseHandler(xhr);
     };
     xhr.send();
 }
 function hideAllComponents() {
+    kuLibrary.open = false;
     var c = document.getElementById('kuapp').children;
     for (var i = 0; i < c.length; i++) {
         c[i].style.display = 'none';
@@ -35,21 +43,31 @@ function hideAllComponents() {
 }
 
 var kuConfig, kuAuth, libInfo, msgEvtSrc;
+var kuLibrary = {open: false, page: 0, perPage: 6, total: 0, returnTo: 'kumessage'};
 
+// kuEventSchema is the version of the event format this page understands.
+// See docs/web-events.md
+var kuEventSchema = 1;
+function onKUEvent(handler) {
+    return function(ev) {
+        var e = JSON.parse(ev.data);
+        if (e.version !== kuEventSchema) {
+            console.log('Unsupported event version ' + e.version + ' for ' + e.type);
+            return;
+        }
+        handler(e.payload);
+    };
+}
 function setupSSE() {
-    msgEvtSrc = new EventSource(kuInfo.ssePath);
-    msgEvtSrc.addEventListener('showMessage', showMessage);
-    msgEvtSrc.addEventListener('progress', showProgress);
-    msgEvtSrc.addEventListener('auth', function(ev) {
-        getKUJson(kuInfo.authPath, showAuthDlg);
-    });
-    msgEvtSrc.addEventListener('calibreInstances', function (ev) {
-        getKUJson(kuInfo.instancePath, showCalInstances);
-    });
-    msgEvtSrc.addEventListener('libInfo', function(ev) {
-        getKUJson(kuInfo.libInfoPath, showLibraryInfo);
-    });
-    msgEvtSrc.addEventListener('kuFinished', showFinishedMsg);
+    msgEvtSrc = new EventSource(kuInfo.ssePath + '?token=' + encodeURIComponent(kuInfo.authToken));
+    msgEvtSrc.addEventListener('showMessage', onKUEvent(showMessage));
+    msgEvtSrc.addEventListener('progress', onKUEvent(showProgress));
+    msgEvtSrc.addEventListener('transferProgress', onKUEvent(showTransferProgress));
+    msgEvtSrc.addEventListener('itemError', onKUEvent(showError));
+    msgEvtSrc.addEventListener('auth', onKUEvent(showAuthDlg));
+    msgEvtSrc.addEventListener('calibreInstances', onKUEvent(showCalInstances));
+    msgEvtSrc.addEventListener('libInfo', onKUEvent(showLibraryInfo));
+    msgEvtSrc.addEventListener('kuFinished', onKUEvent(showFinishedMsg));
 }
 function setupEventHandlers() {
     var startBtn = document.getElementById('cfgStartBtn');
@@ -67,6 +85,114 @@ function setupEventHandlers() {
         disconnectBtn.addEventListener('click', disconnectKU);
         disconnectBtn.dataset.eventDisconnect = "true";
     }
+    var libraryBtns = [document.getElementById('msgLibraryBtn'), document.getElementById('cfgLibraryBtn')];
+    for (var i = 0; i < libraryBtns.length; i++) {
+        if (libraryBtns[i].dataset.eventLibrary === "false") {
+            libraryBtns[i].addEventListener('click', showLibrary);
+            libraryBtns[i].dataset.eventLibrary = "true";
+        }
+    }
+    var libSearchBtn = document.getElementById('libSearchBtn');
+    if (libSearchBtn.dataset.eventLibSearchBtn === "false") {
+        libSearchBtn.addEventListener('click', function() { loadLibraryPage(0); });
+        libSearchBtn.dataset.eventLibSearchBtn = "true";
+    }
+    var libSearch = document.getElementById('libSearch');
+    if (libSearch.dataset.eventLibSearch === "false") {
+        libSearch.addEventListener('keypress', function (e) {
+            if (e.key === 'Enter') {
+                e.preventDefault();
+                loadLibraryPage(0);
+            }
+        });
+        libSearch.dataset.eventLibSearch = "true";
+    }
+    var libPrevBtn = document.getElementById('libPrevBtn');
+    if (libPrevBtn.dataset.eventLibPrev === "false") {
+        libPrevBtn.addEventListener('click', function() { loadLibraryPage(kuLibrary.page - 1); });
+        libPrevBtn.dataset.eventLibPrev = "true";
+    }
+    var libNextBtn = document.getElementById('libNextBtn');
+    if (libNextBtn.dataset.eventLibNext === "false") {
+        libNextBtn.addEventListener('click', function() { loadLibraryPage(kuLibrary.page + 1); });
+        libNextBtn.dataset.eventLibNext = "true";
+    }
+    var libList = document.getElementById('libList');
+    if (libList.dataset.eventLibList === "false") {
+        libList.addEventListener('click', toggleLibraryDelete);
+        libList.dataset.eventLibList = "true";
+    }
+    var libBackBtn = document.getElementById('libBackBtn');
+    if (libBackBtn.dataset.eventLibBack === "false") {
+        libBackBtn.addEventListener('click', closeLibrary);
+        libBackBtn.dataset.eventLibBack = "true";
+    }
+    var diagBtn = document.getElementById('cfgDiagBtn');
+    if (diagBtn.dataset.eventDiag === "false") {
+        diagBtn.addEventListener('click', showDiagnostics);
+        diagBtn.dataset.eventDiag = "true";
+    }
+    var diagVerifyBtn = document.getElementById('diagVerifyBtn');
+    if (diagVerifyBtn.dataset.eventDiagVerify === "false") {
+        diagVerifyBtn.addEventListener('click', verifyLibrary);
+        diagVerifyBtn.dataset.eventDiagVerify = "true";
+    }
+    var storageBtn = document.getElementById('cfgStorageBtn');
+    if (storageBtn.dataset.eventStorage === "false") {
+        storageBtn.addEventListener('click', showStorage);
+        storageBtn.dataset.eventStorage = "true";
+    }
+    var importBtn = document.getElementById('cfgImportBtn');
+    if (importBtn.dataset.eventImport === "false") {
+        var importFile = document.getElementById('cfgImportFile');
+        importBtn.addEventListener('click', function() { importFile.click(); });
+        importFile.addEventListener('change', importConfig);
+        importBtn.dataset.eventImport = "true";
+    }
+    var resetBtn = document.getElementById('cfgResetBtn');
+    if (resetBtn.dataset.eventReset === "false") {
+        resetBtn.addEventListener('click', resetConfig);
+        resetBtn.dataset.eventReset = "true";
+    }
+    var libProfile = document.getElementById('libProfile');
+    if (libProfile.dataset.eventLibProfile === "false") {
+        libProfile.addEventListener('change', function() {
+            readLibProfile();
+            showLibProfile(libProfile.value);
+        });
+        libProfile.dataset.eventLibProfile = "true";
+    }
+    var storageTo = document.getElementById('storageTo');
+    if (storageTo.dataset.eventStorageTo === "false") {
+        storageTo.addEventListener('change', renderStorageList);
+        storageTo.dataset.eventStorageTo = "true";
+    }
+    var storageMoveSelBtn = document.getElementById('storageMoveSelBtn');
+    if (storageMoveSelBtn.dataset.eventStorageMoveSel === "false") {
+        storageMoveSelBtn.addEventListener('click', function() { migrateBooks(false); });
+        storageMoveSelBtn.dataset.eventStorageMoveSel = "true";
+    }
+    var storageMoveAllBtn = document.getElementById('storageMoveAllBtn');
+    if (storageMoveAllBtn.dataset.eventStorageMoveAll === "false") {
+        storageMoveAllBtn.addEventListener('click', function() { migrateBooks(true); });
+        storageMoveAllBtn.dataset.eventStorageMoveAll = "true";
+    }
+    var storageBackBtn = document.getElementById('storageBackBtn');
+    if (storageBackBtn.dataset.eventStorageBack === "false") {
+        storageBackBtn.addEventListener('click', function() {
+            hideAllComponents();
+            document.getElementById('kuconfig').style.display = 'block';
+        });
+        storageBackBtn.dataset.eventStorageBack = "true";
+    }
+    var diagBackBtn = document.getElementById('diagBackBtn');
+    if (diagBackBtn.dataset.eventDiagBack === "false") {
+        diagBackBtn.addEventListener('click', function() {
+            hideAllComponents();
+            document.getElementById('kuconfig').style.display = 'block';
+        });
+        diagBackBtn.dataset.eventDiagBack = "true";
+    }
     var connAddBtn = document.getElementById('cfgAddConn');
     if (connAddBtn.dataset.eventConnAdd === "false") {
         connAddBtn.addEventListener('click', showAddConnection);
@@ -129,39 +255,169 @@ function displayButtonState(btnID, pressed) {
     }
 }
 
-function showMessage(ev) {
+function showMessage(msg) {
     var msgDiv = document.getElementById('kumessage');
-    if (msgDiv.style.display !== 'block') {
+    // Don't pull the user out of the library browser for status updates
+    if (msgDiv.style.display !== 'block' && !kuLibrary.open) {
         hideAllComponents();
         msgDiv.style.display = 'block';
     } 
-    document.getElementById('ku-msgbox').innerHTML = ev.data;
+    document.getElementById('ku-msgbox').innerHTML = msg.message;
 }
-function showProgress(ev) {
+function showProgress(p) {
     var prog = document.getElementById('ku-progress');
-    if (ev.data >= 0 && ev.data <= 100) {
+    if (p.percent >= 0 && p.percent <= 100) {
         var msgDiv = document.getElementById('kumessage');
-        if (msgDiv.style.display !== 'block') {
+        if (msgDiv.style.display !== 'block' && !kuLibrary.open) {
             hideAllComponents();
             msgDiv.style.display = 'block';
         }
-        prog.value = ev.data;
+        prog.value = p.percent;
         prog.style.visibility = 'visible';
     } else {
         prog.style.visibility = 'hidden';
     }
 }
-function showAuthDlg(resp) {
-    if (resp.status === 200) {
-        kuAuth = JSON.parse(resp.responseText);
-        var authDiv = document.getElementById('kuauth');
-        if (authDiv.style.display !== 'block') {
-            hideAllComponents();
-            document.getElementById('authLibName').innerHTML = kuAuth.libName;
-            authDiv.style.display = 'block';
+function showError(e) {
+    var li = document.createElement('li');
+    li.textContent = e.item + ': ' + e.error;
+    document.getElementById('ku-errors').appendChild(li);
+}
+function formatDuration(secs) {
+    secs = Math.round(secs);
+    if (secs >= 60) {
+        return Math.floor(secs / 60) + ' min ' + (secs % 60) + ' s';
+    }
+    return secs + ' s';
+}
+function showTransferProgress(tp) {
+    var pct = tp.bookSize > 0 ? Math.floor(tp.bookBytes * 100 / tp.bookSize) : 100;
+    var bookText = formatBytes(tp.bookBytes) + ' of ' + formatBytes(tp.bookSize) + ' (' + pct + '%)';
+    if (tp.rate > 0) {
+        bookText += ' at ' + formatBytes(Math.round(tp.rate)) + '/s';
+        if (tp.bookBytes < tp.bookSize) {
+            bookText += ', ' + formatDuration(tp.etaSecs) + ' remaining';
+        }
+    }
+    document.getElementById('ku-transfer-book').textContent = bookText;
+    document.getElementById('ku-transfer-session').textContent = 'This session: ' +
+        tp.booksReceived + (tp.booksReceived === 1 ? ' book, ' : ' books, ') + formatBytes(tp.sessionBytes) + ' received';
+    document.getElementById('ku-transfer').style.display = 'block';
+}
+function formatBytes(n) {
+    if (n >= 1048576) {
+        return (n / 1048576).toFixed(1) + ' MB';
+    } else if (n >= 1024) {
+        return Math.round(n / 1024) + ' KB';
+    }
+    return n + ' B';
+}
+function showLibrary() {
+    // Books can be marked before connecting, so remember which screen to go back to
+    kuLibrary.returnTo = document.getElementById('kuconfig').style.display === 'block' ? 'kuconfig' : 'kumessage';
+    hideAllComponents();
+    kuLibrary.open = true;
+    // Fit as many books on a page as the screen allows. Each entry is roughly 5rem high
+    var remPx = parseFloat(document.documentElement.style.fontSize) || 16;
+    var appHeight = document.getElementById('kuapp').clientHeight || window.innerHeight;
+    kuLibrary.perPage = Math.max(3, Math.floor((appHeight - 10 * remPx) / (5 * remPx)));
+    document.getElementById('kulibrary').style.display = 'block';
+    loadLibraryPage(0);
+}
+function closeLibrary() {
+    hideAllComponents();
+    document.getElementById(kuLibrary.returnTo).style.display = 'block';
+}
+function loadLibraryPage(page) {
+    if (page < 0) {
+        return;
+    }
+    var srt = document.getElementById('libSort');
+    var ord = document.getElementById('libOrder');
+    var query = '?search=' + encodeURIComponent(document.getElementById('libSearch').value) +
+        '&sort=' + srt.options[srt.selectedIndex].value +
+        '&order=' + ord.options[ord.selectedIndex].value +
+        '&page=' + page + '&perPage=' + kuLibrary.perPage;
+    getKUJson(kuInfo.libraryPath + query, renderLibrary);
+}
+function renderLibrary(resp) {
+    if (resp.status !== 200) {
+        console.log('renderLibrary: status code expected was 200, got ' + resp.status);
+        return;
+    }
+    var lib = JSON.parse(resp.responseText);
+    kuLibrary.page = lib.page;
+    kuLibrary.total = lib.total;
+    var l = document.getElementById('libList');
+    l.innerHTML = '';
+    for (var i = 0; i < lib.books.length; i++) {
+        var bk = lib.books[i];
+        var li = document.createElement('li');
+        li.dataset.cid = bk.contentID;
+        if (bk.markedDelete) {
+            li.className = 'ku-lib-marked';
         }
-        document.getElementById('password').value = '';
+        var cover = document.createElement('div');
+        cover.className = 'ku-lib-cover';
+        var img = document.createElement('img');
+        img.src = kuInfo.libCoverPath + '?cid=' + encodeURIComponent(bk.contentID);
+        img.onerror = function() { this.style.visibility = 'hidden'; };
+        cover.appendChild(img);
+        var info = document.createElement('div');
+        info.className = 'ku-lib-info';
+        var title = document.createElement('span');
+        title.className = 'ku-lib-title';
+        title.textContent = bk.title;
+        info.appendChild(title);
+        var authors = document.createElement('span');
+        authors.textContent = bk.authors ? bk.authors.join(' & ') : '';
+        info.appendChild(authors);
+        var extra = document.createElement('span');
+        extra.textContent = (bk.series ? bk.series + ' [' + bk.seriesIndex + '] - ' : '') + formatBytes(bk.size);
+        info.appendChild(extra);
+        var action = document.createElement('div');
+        action.className = 'ku-lib-action';
+        var delBtn = document.createElement('button');
+        delBtn.type = 'button';
+        delBtn.textContent = bk.markedDelete ? 'Keep' : 'Delete';
+        action.appendChild(delBtn);
+        li.appendChild(cover);
+        li.appendChild(info);
+        li.appendChild(action);
+        l.appendChild(li);
     }
+    var pages = Math.max(1, Math.ceil(lib.total / lib.perPage));
+    document.getElementById('libPageInfo').textContent = (lib.page + 1) + ' / ' + pages;
+    document.getElementById('libPrevBtn').disabled = lib.page <= 0;
+    document.getElementById('libNextBtn').disabled = lib.page + 1 >= pages;
+    document.getElementById('libBookCount').textContent = lib.total + ' books';
+}
+function toggleLibraryDelete(ev) {
+    if (!ev.target || ev.target.nodeName !== 'BUTTON') {
+        return;
+    }
+    var li = ev.target.parentNode.parentNode;
+    var marked = li.className !== 'ku-lib-marked';
+    var xhr = newKUxhr('POST', kuInfo.libDeletePath);
+    xhr.onload = function () {
+        if (xhr.status === 204) {
+            li.className = marked ? 'ku-lib-marked' : '';
+            ev.target.textContent = marked ? 'Keep' : 'Delete';
+        } else {
+            console.log('toggleLibraryDelete: status code expected was 204, got ' + xhr.status);
+        }
+    };
+    xhr.send(JSON.stringify({contentID: li.dataset.cid, marked: marked}));
+}
+function showAuthDlg(auth) {
+    kuAuth = auth;
+    var authDiv = document.getElementById('kuauth');
+    if (authDiv.style.display !== 'block') {
+        hideAllComponents();
+        document.getElementById('authLibName').textContent = kuAuth.libName;
+        authDiv.style.display = 'block';
+    }
+    document.getElementById('password').value = '';
 }
 function showAddConnection(ev) {
     hideAllComponents();
@@ -212,8 +468,7 @@ function setConnDelState(ev) {
 function sendAuth() {
     displayButtonState('authLoginBtn', true)
     kuAuth.password = document.getElementById('password').value;
-    var xhr = new XMLHttpRequest();
-    xhr.open('POST', kuInfo.authPath);
+    var xhr = newKUxhr('POST', kuInfo.authPath);
     xhr.onload = function () {
         if (xhr.status === 204) {
             displayButtonState('authLoginBtn', false)
@@ -224,24 +479,22 @@ function sendAuth() {
     }
     xhr.send(JSON.stringify(kuAuth));
 }
-function showCalInstances(resp) {
-    if (resp.status === 200) {
-        var kuCalInstances = JSON.parse(resp.responseText);
-        var l = document.getElementById('calInstanceList');
-        l.innerHTML = '';
-        for (var i = 0; i < kuCalInstances.length; i++) {
-            var instListItem = document.createElement('li');
-            instListItem.dataset.instanceHost = kuCalInstances[i].host;
-            instListItem.dataset.instancePort = kuCalInstances[i].port;
-            instListItem.dataset.instanceName = kuCalInstances[i].name;
-            instListItem.innerHTML = kuCalInstances[i].host + ' :: ' + kuCalInstances[i].name;
-            l.appendChild(instListItem);
-        }
-        var instDiv = document.getElementById('kuinstances');
-        if (instDiv.style.display !== "block") {
-            hideAllComponents();
-            instDiv.style.display = "block";
-        }
+function showCalInstances(ci) {
+    var kuCalInstances = ci.instances;
+    var l = document.getElementById('calInstanceList');
+    l.innerHTML = '';
+    for (var i = 0; i < kuCalInstances.length; i++) {
+        var instListItem = document.createElement('li');
+        instListItem.dataset.instanceHost = kuCalInstances[i].host;
+        instListItem.dataset.instancePort = kuCalInstances[i].port;
+        instListItem.dataset.instanceName = kuCalInstances[i].name;
+        instListItem.textContent = kuCalInstances[i].host + ' :: ' + kuCalInstances[i].name;
+        l.appendChild(instListItem);
+    }
+    var instDiv = document.getElementById('kuinstances');
+    if (instDiv.style.display !== "block") {
+        hideAllComponents();
+        instDiv.style.display = "block";
     }
 }
 function selectCalInstance(ev) {
@@ -252,8 +505,7 @@ function selectCalInstance(ev) {
             port: parseInt(t.dataset.instancePort, 10),
             name: t.dataset.instanceName,
         }
-        var xhr = new XMLHttpRequest();
-        xhr.open('POST', kuInfo.instancePath);
+        var xhr = newKUxhr('POST', kuInfo.instancePath);
         xhr.onload = function () {
             if (xhr.status === 204) {
                 hideAllComponents();
@@ -265,22 +517,42 @@ function selectCalInstance(ev) {
     }
 }
 
-function showLibraryInfo(resp) {
-    if (resp.status === 200) {
-        libInfo = JSON.parse(resp.responseText);
-        var fieldSel = document.getElementById('kuSubtitleColumn');
-        for (var i = 0; i < libInfo.subtitleFields.length; i++) {
-            var fieldOpt = document.createElement('option');
-            fieldOpt.value = libInfo.subtitleFields[i];
-            fieldOpt.innerHTML = libInfo.subtitleFields[i];
-            if (libInfo.currSel === i) {
-                fieldOpt.selected = true;
-            }
-            fieldSel.appendChild(fieldOpt);
+function showLibraryInfo(li) {
+    libInfo = li;
+    document.getElementById('kuLibNotice').textContent = libInfo.notice || '';
+    var fieldSel = document.getElementById('kuSubtitleColumn');
+    // The library info may be sent again if the page reconnects
+    fieldSel.innerHTML = '';
+    for (var i = 0; i < libInfo.subtitleFields.length; i++) {
+        var fieldOpt = document.createElement('option');
+        fieldOpt.value = libInfo.subtitleFields[i];
+        fieldOpt.textContent = libInfo.subtitleFields[i];
+        if (libInfo.currSel === i) {
+            fieldOpt.selected = true;
         }
-        fieldSel.addEventListener('change', sendLibraryInfo);
-        fieldSel.disabled = false;
+        fieldSel.appendChild(fieldOpt);
+    }
+    fieldSel.addEventListener('change', sendLibraryInfo);
+    fieldSel.disabled = false;
+    var fieldMap = document.getElementById('kuFieldMap');
+    fieldMap.value = formatMapLines(libInfo.fieldMap);
+    fieldMap.addEventListener('change', sendLibraryInfo);
+    fieldMap.disabled = false;
+    var collCols = document.getElementById('kuCollectionColumns');
+    collCols.value = (libInfo.collectionColumns || []).join(', ');
+    collCols.addEventListener('change', sendLibraryInfo);
+    collCols.disabled = false;
+    var readSel = document.getElementById('kuReadStatusColumn');
+    readSel.innerHTML = '';
+    for (var j = 0; j < libInfo.readStatusFields.length; j++) {
+        var readOpt = document.createElement('option');
+        readOpt.value = libInfo.readStatusFields[j];
+        readOpt.textContent = libInfo.readStatusFields[j];
+        readOpt.selected = libInfo.readStatusFields[j] === libInfo.readStatusColumn;
+        readSel.appendChild(readOpt);
     }
+    readSel.addEventListener('change', sendLibraryInfo);
+    readSel.disabled = false;
 }
 
 function sendLibraryInfo(ev) {
@@ -290,17 +562,102 @@ function sendLibraryInfo(ev) {
         if (el.selectedIndex > 0) {
             libInfo.currSel = el.selectedIndex;
         }
+    } else if (el.id === 'kuFieldMap') {
+        libInfo.fieldMap = parseMapLines(el.value);
+    } else if (el.id === 'kuCollectionColumns') {
+        libInfo.collectionColumns = el.value.split(',').map(function (c) {
+            return c.trim();
+        }).filter(function (c) {
+            return c !== '';
+        });
+    } else if (el.id === 'kuReadStatusColumn') {
+        libInfo.readStatusColumn = el.value;
     }
-    var xhr = new XMLHttpRequest();
-    xhr.open('POST', kuInfo.libInfoPath);
+    var xhr = newKUxhr('POST', kuInfo.libInfoPath);
     xhr.onload = function () {
-        if (xhr.status !== 204) {
+        var errEl = document.getElementById('kuFieldMapErr');
+        errEl.textContent = '';
+        if (xhr.status === 400) {
+            errEl.textContent = xhr.responseText;
+        } else if (xhr.status !== 204) {
             console.log('showLibraryInfo status code expected was 204, got ' + xhr.status);
         }
     }
     xhr.send(JSON.stringify(libInfo));
 }
 
+// Series aliases and field maps are edited as lines of 'key = value'
+function parseMapLines(text) {
+    var m = {};
+    var lines = text.split('\n');
+    for (var i = 0; i < lines.length; i++) {
+        var sep = lines[i].indexOf('=');
+        if (sep < 0) {
+            continue;
+        }
+        var key = lines[i].substring(0, sep).trim();
+        var value = lines[i].substring(sep + 1).trim();
+        if (key !== '' && value !== '') {
+            m[key] = value;
+        }
+    }
+    return m;
+}
+
+function formatMapLines(m) {
+    var lines = [];
+    for (var key in m) {
+        lines.push(key + ' = ' + m[key]);
+    }
+    return lines.join('\n');
+}
+
+// Library profiles only store the options that differ from the global options. A null
+// value means the global option is used.
+function optBool(val) {
+    return val === '' ? null : val === 'true';
+}
+
+function fmtOptBool(val) {
+    return (val === null || val === undefined) ? '' : String(val);
+}
+
+function showLibProfile(uuid) {
+    var opts = document.getElementById('libProfileOpts');
+    opts.dataset.uuid = uuid;
+    if (uuid === '') {
+        opts.style.display = 'none';
+        return;
+    }
+    var prof = kuConfig.opts.libOptions[uuid];
+    document.getElementById('profPreferSDCard').value = fmtOptBool(prof.preferSDCard);
+    document.getElementById('profPreferKepub').value = fmtOptBool(prof.preferKepub);
+    document.getElementById('profGenerateLevel').value = prof.thumbnail ? prof.thumbnail.generateLevel : '';
+    document.getElementById('profLpathTemplate').value = prof.lpathTemplate ? prof.lpathTemplate : '';
+    opts.style.display = 'block';
+}
+
+function readLibProfile() {
+    var uuid = document.getElementById('libProfileOpts').dataset.uuid;
+    if (!uuid) {
+        return;
+    }
+    var prof = kuConfig.opts.libOptions[uuid];
+    prof.preferSDCard = optBool(document.getElementById('profPreferSDCard').value);
+    prof.preferKepub = optBool(document.getElementById('profPreferKepub').value);
+    var level = document.getElementById('profGenerateLevel').value;
+    prof.thumbnail = null;
+    if (level !== '') {
+        prof.thumbnail = {
+            generateLevel: level,
+            resizeAlgorithm: kuConfig.opts.thumbnail.resizeAlgorithm,
+            jpegQuality: kuConfig.opts.thumbnail.jpegQuality
+        };
+    }
+    var tmpl = document.getElementById('profLpathTemplate').value.trim();
+    prof.lpathTemplate = tmpl === '' ? null : tmpl;
+}
+
 function sendConfig() {
     displayButtonState('cfgExitBtn', true);
     var gl = document.getElementById('generateLevel');
@@ -308,6 +665,7 @@ function sendConfig() {
     kuConfig.opts.preferSDCard = document.getElementById('preferSDCard').checked;
     kuConfig.opts.preferKepub = document.getElementById('preferKepub').checked;
     kuConfig.opts.enableDebug = document.getElementById('enableDebug').checked;
+    kuConfig.opts.disablePassCache = document.getElementById('disablePassCache').checked;
     kuConfig.opts.thumbnail.generateLevel = gl.options[gl.selectedIndex].value;
     kuConfig.opts.thumbnail.resizeAlgorithm = rs.options[rs.selectedIndex].value;
     var jpgQuality = parseInt(document.getElementById('jpegQuality').value);
@@ -315,19 +673,70 @@ function sendConfig() {
         jpgQuality = 50;
     }
     kuConfig.opts.thumbnail.jpegQuality = jpgQuality;
+    var reserveMB = parseInt(document.getElementById('reserveSpaceMB').value, 10);
+    kuConfig.opts.reserveSpaceMB = (isNaN(reserveMB) || reserveMB < 0) ? 0 : reserveMB;
+    kuConfig.opts.lpathTemplate = document.getElementById('lpathTemplate').value.trim();
+    var sp = document.getElementById('sanitizeProfile');
+    kuConfig.opts.sanitizeProfile = sp.options[sp.selectedIndex].value;
+    kuConfig.opts.seriesAliases = parseMapLines(document.getElementById('seriesAliases').value);
+    var nf = document.querySelectorAll('[data-nickel-field]');
+    for (var i = 0; i < nf.length; i++) {
+        kuConfig.opts.nickelFields[nf[i].getAttribute('data-nickel-field')] = nf[i].checked;
+    }
+    var mb = document.getElementById('metadataBackend');
+    kuConfig.opts.metadataBackend = mb.options[mb.selectedIndex].value;
     kuConfig.opts.directConnIndex = document.getElementById('directConn').selectedIndex - 1;
-    var xhr = new XMLHttpRequest();
-    xhr.open('POST', kuInfo.configPath);
+    readLibProfile();
+    var xhr = newKUxhr('POST', kuInfo.configPath);
     xhr.onload = function (btn) {
         if (xhr.status === 204) {
             displayButtonState('cfgExitBtn', false);
             hideAllComponents();
+        } else if (xhr.status === 400) {
+            displayButtonState('cfgExitBtn', false);
+            document.getElementById('cfgHelp').textContent = xhr.responseText;
         } else {
             console.log('sendConfig: status code expected was 204, got ' + xhr.status);
         }
     };
     xhr.send(JSON.stringify(kuConfig));
 }
+// Imported and reset configs are shown on the config page, and saved when Start is pressed
+function handleReplacedConfig(xhr, msg) {
+    if (xhr.status === 200) {
+        handleShowKUCfg(xhr);
+        var warning = kuConfig.warning ? ' ' + kuConfig.warning : '';
+        document.getElementById('cfgHelp').textContent = msg + warning + ' Press Start to save and use it, or Exit to keep your current config.';
+    } else {
+        document.getElementById('cfgHelp').textContent = xhr.responseText;
+    }
+}
+function importConfig(ev) {
+    var file = ev.target.files[0];
+    if (!file) {
+        return;
+    }
+    var reader = new FileReader();
+    reader.onload = function() {
+        var xhr = newKUxhr('POST', kuInfo.configImpPath);
+        xhr.onload = function() {
+            handleReplacedConfig(xhr, 'Config imported.');
+        };
+        xhr.send(reader.result);
+    };
+    reader.readAsText(file);
+    ev.target.value = '';
+}
+function resetConfig() {
+    if (!window.confirm('Reset all options, direct connections and library profiles to their defaults?')) {
+        return;
+    }
+    var xhr = newKUxhr('POST', kuInfo.configResetPath);
+    xhr.onload = function() {
+        handleReplacedConfig(xhr, 'Options reset to defaults.');
+    };
+    xhr.send();
+}
 function exitKU() {
     displayButtonState('cfgExitBtn', true)
     getKUJson(kuInfo.exitPath, function(resp) {
@@ -339,12 +748,214 @@ function exitKU() {
         }
     });
 }
-function showFinishedMsg(ev) {
+function showFinishedMsg(fin) {
     hideAllComponents();
     var exitDiv = document.getElementById('kuexit');
-    exitDiv.innerHTML = '<h2>' + ev.data + '</h2>';
+    exitDiv.innerHTML = '<h2>' + fin.message + '</h2>';
+    if (fin.summary) {
+        exitDiv.appendChild(renderSessionSummary(fin.summary));
+    }
     exitDiv.style.display = 'block';
 }
+function renderSessionSummary(summary) {
+    var div = document.createElement('div');
+    div.className = 'ku-summary';
+    var rows = [
+        ['Books received', summary.booksReceived],
+        ['Books replaced', summary.booksReplaced],
+        ['Books deleted', summary.booksDeleted],
+        ['Books sent to Calibre', summary.booksSent],
+        ['Metadata updated', summary.metadataUpdated],
+        ['Covers generated', summary.coversGenerated],
+        ['Data received', formatBytes(summary.bytesReceived)],
+        ['Data sent', formatBytes(summary.bytesSent)],
+        ['Duration', Math.round(summary.durationSecs) + ' s']
+    ];
+    var table = document.createElement('table');
+    for (var i = 0; i < rows.length; i++) {
+        var tr = document.createElement('tr');
+        var th = document.createElement('th');
+        th.textContent = rows[i][0];
+        var td = document.createElement('td');
+        td.textContent = rows[i][1];
+        tr.appendChild(th);
+        tr.appendChild(td);
+        table.appendChild(tr);
+    }
+    div.appendChild(table);
+    if (summary.errors && summary.errors.length > 0) {
+        var h = document.createElement('h3');
+        h.textContent = 'Errors';
+        div.appendChild(h);
+        var ul = document.createElement('ul');
+        for (var j = 0; j < summary.errors.length; j++) {
+            var li = document.createElement('li');
+            li.textContent = summary.errors[j].item + ': ' + summary.errors[j].error;
+            ul.appendChild(li);
+        }
+        div.appendChild(ul);
+    }
+    return div;
+}
+function showDiagnostics() {
+    getKUJson(kuInfo.diagnosticsPath, function(resp) {
+        if (resp.status !== 200) {
+            console.log('showDiagnostics: status code expected was 200, got ' + resp.status);
+            return;
+        }
+        var diag = JSON.parse(resp.responseText);
+        var rows = [
+            ['KU Version', diag.kuVersion],
+            ['Device', diag.deviceModel],
+            ['Firmware', diag.firmware],
+            ['Storage', diag.storageType],
+            ['Free Space', diag.freeSpaceError ? diag.freeSpaceError : formatBytes(diag.freeSpace)],
+            ['Config', JSON.stringify(diag.config)]
+        ];
+        var info = document.getElementById('diagInfo');
+        info.innerHTML = '';
+        for (var i = 0; i < rows.length; i++) {
+            var tr = document.createElement('tr');
+            var th = document.createElement('th');
+            th.textContent = rows[i][0];
+            var td = document.createElement('td');
+            td.textContent = rows[i][1];
+            tr.appendChild(th);
+            tr.appendChild(td);
+            info.appendChild(tr);
+        }
+        var sessions = document.getElementById('diagSessions');
+        sessions.innerHTML = '';
+        // Show the most recent session first
+        for (var j = diag.sessions.length - 1; j >= 0; j--) {
+            var s = diag.sessions[j];
+            var h = document.createElement('h4');
+            h.textContent = new Date(s.start).toLocaleString() + ' - ' + (s.libraryName || 'No library') + ' (' + s.firmware + ')';
+            sessions.appendChild(h);
+            var result = document.createElement('p');
+            result.textContent = s.result;
+            sessions.appendChild(result);
+            sessions.appendChild(renderSessionSummary(s));
+        }
+        document.getElementById('diagLog').textContent = diag.recentLog.join('\n');
+        hideAllComponents();
+        document.getElementById('kudiagnostics').style.display = 'block';
+    });
+}
+var kuStorage = null;
+function showStorage() {
+    getKUJson(kuInfo.storagePath, function(resp) {
+        if (resp.status !== 200) {
+            console.log('showStorage: status code expected was 200, got ' + resp.status);
+            return;
+        }
+        kuStorage = JSON.parse(resp.responseText);
+        // Default to moving books to the storage currently in use
+        document.getElementById('storageTo').value = kuStorage.current;
+        document.getElementById('storageResult').textContent = '';
+        renderStorageList();
+        hideAllComponents();
+        document.getElementById('kustorage').style.display = 'block';
+    });
+}
+function renderStorageList() {
+    var to = document.getElementById('storageTo').value;
+    var books = (to === 'sd') ? kuStorage.onboard : kuStorage.sd;
+    var from = (to === 'sd') ? 'internal storage' : 'the SD card';
+    document.getElementById('storageSummary').textContent = books.length + ' book(s) on ' + from;
+    var list = document.getElementById('storageList');
+    list.innerHTML = '';
+    for (var i = 0; i < books.length; i++) {
+        var li = document.createElement('li');
+        var cb = document.createElement('input');
+        cb.type = 'checkbox';
+        cb.id = 'storageBook' + i;
+        cb.value = books[i].contentID;
+        var lbl = document.createElement('label');
+        lbl.htmlFor = cb.id;
+        lbl.textContent = books[i].title + ' - ' + (books[i].authors || []).join(', ') + ' (' + formatBytes(books[i].size) + ')';
+        li.appendChild(cb);
+        li.appendChild(lbl);
+        list.appendChild(li);
+    }
+}
+function migrateBooks(all) {
+    var req = {to: document.getElementById('storageTo').value, contentIDs: []};
+    if (!all) {
+        var boxes = document.querySelectorAll('#storageList input[type=checkbox]');
+        for (var i = 0; i < boxes.length; i++) {
+            if (boxes[i].checked) {
+                req.contentIDs.push(boxes[i].value);
+            }
+        }
+        if (req.contentIDs.length === 0) {
+            return;
+        }
+    }
+    var out = document.getElementById('storageResult');
+    out.textContent = 'Moving books. This may take a while...';
+    displayButtonState('storageMoveSelBtn', true);
+    displayButtonState('storageMoveAllBtn', true);
+    var xhr = newKUxhr('POST', kuInfo.migratePath);
+    xhr.onload = function () {
+        displayButtonState('storageMoveSelBtn', false);
+        displayButtonState('storageMoveAllBtn', false);
+        if (xhr.status !== 200) {
+            out.textContent = 'Moving books failed: ' + xhr.responseText;
+            return;
+        }
+        var res = JSON.parse(xhr.responseText);
+        out.textContent = res.moved + ' book(s) moved.';
+        if (res.moved > 0) {
+            out.textContent += ' Nickel is updated when KU exits, so please exit, and start KU again to connect to Calibre.';
+            document.getElementById('cfgStartBtn').style.display = 'none';
+        }
+        if (res.errors.length > 0) {
+            var ul = document.createElement('ul');
+            for (var i = 0; i < res.errors.length; i++) {
+                var li = document.createElement('li');
+                li.textContent = res.errors[i].item + ': ' + res.errors[i].error;
+                ul.appendChild(li);
+            }
+            out.appendChild(ul);
+        }
+        // Refresh the book lists, keeping the result visible
+        getKUJson(kuInfo.storagePath, function(resp) {
+            if (resp.status === 200) {
+                kuStorage = JSON.parse(resp.responseText);
+                renderStorageList();
+            }
+        });
+    };
+    xhr.send(JSON.stringify(req));
+}
+function verifyLibrary() {
+    var out = document.getElementById('diagVerify');
+    out.textContent = 'Verifying books. This may take a while...';
+    displayButtonState('diagVerifyBtn', true);
+    var xhr = newKUxhr('POST', kuInfo.verifyPath);
+    xhr.onload = function () {
+        displayButtonState('diagVerifyBtn', false);
+        if (xhr.status !== 200) {
+            out.textContent = 'Verification failed: ' + xhr.responseText;
+            return;
+        }
+        var problems = JSON.parse(xhr.responseText);
+        if (problems.length === 0) {
+            out.textContent = 'No problems found';
+            return;
+        }
+        out.textContent = '';
+        var ul = document.createElement('ul');
+        for (var i = 0; i < problems.length; i++) {
+            var li = document.createElement('li');
+            li.textContent = problems[i].title + ': ' + problems[i].problem;
+            ul.appendChild(li);
+        }
+        out.appendChild(ul);
+    };
+    xhr.send();
+}
 function disconnectKU() {
     displayButtonState('cfgDisconnectBtn', true)
     getKUJson(kuInfo.disconnectPath, function(resp) {
@@ -360,10 +971,38 @@ function handleShowKUCfg(resp) {
         document.getElementById('preferSDCard').checked = kuConfig.opts.preferSDCard;
         document.getElementById('preferKepub').checked = kuConfig.opts.preferKepub;
         document.getElementById('enableDebug').checked = kuConfig.opts.enableDebug;
+        document.getElementById('disablePassCache').checked = kuConfig.opts.disablePassCache;
         document.getElementById('generateLevel').value = kuConfig.opts.thumbnail.generateLevel;
         document.getElementById('resizeAlgorithm').value = kuConfig.opts.thumbnail.resizeAlgorithm;
         document.getElementById('jpegQuality').value = kuConfig.opts.thumbnail.jpegQuality;
+        document.getElementById('reserveSpaceMB').value = kuConfig.opts.reserveSpaceMB;
+        if (kuInfo.hasSDCard) {
+            document.getElementById('cfgStorageBtn').style.display = 'inline-block';
+        }
+        document.getElementById('lpathTemplate').value = kuConfig.opts.lpathTemplate;
+        document.getElementById('sanitizeProfile').value = kuConfig.opts.sanitizeProfile;
+        document.getElementById('metadataBackend').value = kuConfig.opts.metadataBackend;
+        document.getElementById('seriesAliases').value = formatMapLines(kuConfig.opts.seriesAliases);
+        var nf = document.querySelectorAll('[data-nickel-field]');
+        for (var j = 0; j < nf.length; j++) {
+            nf[j].checked = kuConfig.opts.nickelFields[nf[j].getAttribute('data-nickel-field')];
+        }
+        var lp = document.getElementById('libProfile');
+        var libs = Object.keys(kuConfig.opts.libOptions || {});
+        libs.sort(function(a, b) {
+            return kuConfig.opts.libOptions[a].libraryName.localeCompare(kuConfig.opts.libOptions[b].libraryName);
+        });
+        lp.length = 1;
+        for (var k = 0; k < libs.length; k++) {
+            var libOpt = document.createElement('option');
+            libOpt.value = libs[k];
+            libOpt.text = kuConfig.opts.libOptions[libs[k]].libraryName || libs[k];
+            lp.add(libOpt);
+        }
+        lp.value = '';
+        showLibProfile('');
         var dc = document.getElementById('directConn');
+        dc.length = 1;
         if (kuConfig.opts.directConnIndex < 0) {
             dc.selectedIndex = 0;
         }
@@ -375,9 +1014,9 @@ function handleShowKUCfg(resp) {
                 dc.selectedIndex = i + 1;
             }
         }
-        if (dc.selectedIndex == 0) {
-            document.getElementById('cfgDelConn').disabled = true;
-        }
+        document.getElementById('cfgDelConn').disabled = dc.selectedIndex == 0;
+        document.getElementById('cfgExportLink').href = kuInfo.configExpPath;
+        document.getElementById('cfgHelp').textContent = kuConfig.warning ? kuConfig.warning : '';
         document.getElementById('kuconfig').style.display = 'block';
     }
 }
@@ -0,0 +1,201 @@
+// Copyright 2019-2020 Sherman Perry
+
+// This file is part of Kobo UNCaGED.
+
+// Kobo UNCaGED is free software: you can redistribute it and/or modify
+// it under the terms of the Affero GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Kobo UNCaGED is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with Kobo UNCaGED.  If not, see <https://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Filename sanitization profiles
+const (
+	// SanitizeFAT enforces the rules of the FAT32 and exFAT filesystems used by Kobo devices
+	SanitizeFAT = "fat"
+	// SanitizeLegacy only replaces the characters replaced by older versions of KU
+	SanitizeLegacy = "legacy"
+)
+
+// MaxLpathLen is the maximum length of an lpath, in UTF-16 code units. It is the same
+// limit Calibre uses for Kobo devices over USB, which leaves room for the longest path
+// Nickel creates from a book path on a Windows computer.
+const MaxLpathLen = 185
+
+// maxComponentLen is the maximum length of a single FAT long filename, in UTF-16 code units
+const maxComponentLen = 255
+
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// ValidSanitizeProfile reports whether profile is a known sanitization profile
+func ValidSanitizeProfile(profile string) bool {
+	return profile == SanitizeFAT || profile == SanitizeLegacy
+}
+
+// SanitizeLpath makes lpath safe to use as a path relative to the book root, using the rules of
+// the named profile. Unknown profiles are treated as SanitizeFAT. Sanitizing an lpath that has
+// already been sanitized with the same profile does not change it.
+func SanitizeLpath(lpath, profile string) string {
+	var comps []string
+	for _, c := range strings.Split(strings.Replace(lpath, "\\", "/", -1), "/") {
+		// Never allow an lpath to escape the book root
+		if c == "" || c == "." || c == ".." {
+			continue
+		}
+		comps = append(comps, c)
+	}
+	if profile == SanitizeLegacy {
+		return SanitizeFilepath(strings.Join(comps, "/"))
+	}
+	for i, c := range comps {
+		comps[i] = sanitizeComponent(c)
+	}
+	shortenComponents(comps, MaxLpathLen)
+	return strings.Join(comps, "/")
+}
+
+// sanitizeComponent applies the SanitizeFAT rules to a single path component
+func sanitizeComponent(c string) string {
+	c = ComposeNFC(c)
+	c = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == utf8.RuneError {
+			return '_'
+		}
+		return r
+	}, SanitizeFilepath(c))
+	// Windows (and the vfat driver) silently drop trailing dots and spaces
+	trimmed := strings.TrimRight(c, ". ")
+	if trimmed != c {
+		c = trimmed + "_"
+	}
+	base := c
+	if i := strings.IndexByte(c, '.'); i >= 0 {
+		base = c[:i]
+	}
+	if reservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+		c = base + "_" + c[len(base):]
+	}
+	return c
+}
+
+// shortenComponents shortens the longest components in comps until the joined path is no
+// longer than maxLen, and no component is longer than maxComponentLen. The extension of
+// the last component (the filename) is preserved.
+func shortenComponents(comps []string, maxLen int) {
+	if len(comps) == 0 {
+		return
+	}
+	last := len(comps) - 1
+	ext := LpathExt(comps[last])
+	comps[last] = strings.TrimSuffix(comps[last], ext)
+	total := utf16Len(ext) + len(comps) - 1
+	truncated := make(map[int]bool)
+	for i, c := range comps {
+		limit := maxComponentLen
+		if i == last {
+			limit -= utf16Len(ext)
+		}
+		if l := utf16Len(c); l > limit {
+			comps[i] = truncateUTF16(c, limit)
+			truncated[i] = true
+		}
+		total += utf16Len(comps[i])
+	}
+	for total > maxLen {
+		// Shorten the longest component, but no further than the next longest, so that
+		// long paths are shortened evenly
+		longest, next := 0, 1
+		for i, c := range comps {
+			if l := utf16Len(c); l > utf16Len(comps[longest]) {
+				longest = i
+			}
+		}
+		l := utf16Len(comps[longest])
+		if l <= 1 {
+			break
+		}
+		for i, c := range comps {
+			if cl := utf16Len(c); i != longest && cl > next {
+				next = cl
+			}
+		}
+		cut := total - maxLen
+		if next < l && cut > l-next {
+			cut = l - next
+		} else if next >= l {
+			cut = 1
+		}
+		comps[longest] = truncateUTF16(comps[longest], l-cut)
+		truncated[longest] = true
+		total -= l - utf16Len(comps[longest])
+	}
+	for i := range truncated {
+		// Truncating may leave a trailing dot or space behind
+		if t := strings.TrimRight(comps[i], ". "); t != comps[i] {
+			comps[i] = t + "_"
+		}
+	}
+	comps[last] += ext
+}
+
+// LpathExt returns the extension of a filename, treating ".kepub.epub" as a single extension
+func LpathExt(fn string) string {
+	if strings.HasSuffix(strings.ToLower(fn), ".kepub.epub") {
+		return fn[len(fn)-len(".kepub.epub"):]
+	}
+	return path.Ext(fn)
+}
+
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// truncateUTF16 truncates s to at most n UTF-16 code units, without splitting a character
+func truncateUTF16(s string, n int) string {
+	l := 0
+	for i, r := range s {
+		rl := 1
+		if r >= 0x10000 {
+			rl = 2
+		}
+		if l+rl > n {
+			return s[:i]
+		}
+		l += rl
+	}
+	return s
+}
+
+// ComposeNFC converts s to Unicode NFC, as macOS and some ebook tools store characters
+// decomposed
+func ComposeNFC(s string) string {
+	return norm.NFC.String(s)
+}
@@ -0,0 +1,56 @@
+// Copyright 2019-2020 Sherman Perry
+
+// This file is part of Kobo UNCaGED.
+
+// Kobo UNCaGED is free software: you can redistribute it and/or modify
+// it under the terms of the Affero GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Kobo UNCaGED is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with Kobo UNCaGED.  If not, see <https://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"strings"
+	"unicode"
+)
+
+// seriesArticles are ignored at the start (or, as in "Expanse, The", the end) of a series name
+var seriesArticles = map[string]bool{"the": true, "a": true, "an": true}
+
+// seriesSuffixes are ignored at the end of a series name
+var seriesSuffixes = map[string]bool{
+	"series": true, "trilogy": true, "duology": true, "saga": true, "cycle": true,
+	"sequence": true, "novels": true, "books": true, "collection": true,
+}
+
+// NormalizeSeries reduces a series name to a form that can be compared with other series
+// names. Case, punctuation, leading and trailing articles, and suffixes such as "Series"
+// and "Trilogy" are ignored, so "The Expanse", "Expanse, The" and "The Expanse Series"
+// are all the same series.
+func NormalizeSeries(series string) string {
+	words := strings.FieldsFunc(strings.ToLower(ComposeNFC(series)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+	})
+	// Apostrophes are removed rather than splitting words, so "Ender's" matches "Enders"
+	for i := range words {
+		words[i] = strings.Replace(words[i], "'", "", -1)
+	}
+	if len(words) > 1 && seriesArticles[words[0]] {
+		words = words[1:]
+	}
+	for len(words) > 1 && seriesSuffixes[words[len(words)-1]] {
+		words = words[:len(words)-1]
+	}
+	if len(words) > 1 && seriesArticles[words[len(words)-1]] {
+		words = words[:len(words)-1]
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,225 @@
+// Copyright 2019-2020 Sherman Perry
+
+// This file is part of Kobo UNCaGED.
+
+// Kobo UNCaGED is free software: you can redistribute it and/or modify
+// it under the terms of the Affero GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Kobo UNCaGED is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with Kobo UNCaGED.  If not, see <https://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseTOML parses the subset of TOML used by the config files of older versions of KU:
+// tables, and keys with string, integer, float, boolean or array values. Keys in a table
+// are returned as "table.key".
+func ParseTOML(data []byte) (map[string]interface{}, error) {
+	p := &tomlParser{s: string(data), line: 1}
+	out := make(map[string]interface{})
+	table := ""
+	for {
+		p.skipSpace(true)
+		if p.eof() {
+			return out, nil
+		}
+		if p.peek() == '[' {
+			p.pos++
+			end := strings.IndexByte(p.s[p.pos:], ']')
+			if end < 0 {
+				return nil, p.errorf("missing ']'")
+			}
+			table = strings.TrimSpace(p.s[p.pos : p.pos+end])
+			if !isBareKey(table) {
+				return nil, p.errorf("invalid table name '%s'", table)
+			}
+			p.pos += end + 1
+		} else {
+			key, err := p.key()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace(false)
+			if p.eof() || p.peek() != '=' {
+				return nil, p.errorf("expected '=' after '%s'", key)
+			}
+			p.pos++
+			p.skipSpace(false)
+			val, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			if table != "" {
+				key = table + "." + key
+			}
+			if _, exists := out[key]; exists {
+				return nil, p.errorf("'%s' is set more than once", key)
+			}
+			out[key] = val
+		}
+		p.skipSpace(false)
+		if !p.eof() && p.peek() != '\n' && p.peek() != '\r' {
+			return nil, p.errorf("unexpected '%c'", p.peek())
+		}
+	}
+}
+
+type tomlParser struct {
+	s    string
+	pos  int
+	line int
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *tomlParser) peek() byte {
+	return p.s[p.pos]
+}
+
+func (p *tomlParser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("ParseTOML: line %d: %s", p.line, fmt.Sprintf(format, a...))
+}
+
+// skipSpace skips spaces and comments, and newlines as well if newlines is set
+func (p *tomlParser) skipSpace(newlines bool) {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case c == '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		case newlines && (c == '\n' || c == '\r'):
+			if c == '\n' {
+				p.line++
+			}
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func isBareKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *tomlParser) key() (string, error) {
+	if c := p.peek(); c == '"' || c == '\'' {
+		return p.str()
+	}
+	start := p.pos
+	for !p.eof() && isBareKey(p.s[p.pos:p.pos+1]) {
+		p.pos++
+	}
+	if start == p.pos {
+		return "", p.errorf("expected a key")
+	}
+	return p.s[start:p.pos], nil
+}
+
+// str parses a basic ("...") or literal ('...') string on a single line
+func (p *tomlParser) str() (string, error) {
+	quote := p.peek()
+	if strings.HasPrefix(p.s[p.pos:], strings.Repeat(string(quote), 3)) {
+		return "", p.errorf("multi-line strings are not supported")
+	}
+	for i := p.pos + 1; i < len(p.s); i++ {
+		switch p.s[i] {
+		case '\n':
+			return "", p.errorf("missing closing quote")
+		case '\\':
+			if quote == '"' {
+				i++
+			}
+		case quote:
+			raw := p.s[p.pos : i+1]
+			p.pos = i + 1
+			if quote == '\'' {
+				return raw[1 : len(raw)-1], nil
+			}
+			s, err := strconv.Unquote(raw)
+			if err != nil {
+				return "", p.errorf("invalid string %s", raw)
+			}
+			return s, nil
+		}
+	}
+	return "", p.errorf("missing closing quote")
+}
+
+func (p *tomlParser) value() (interface{}, error) {
+	if p.eof() {
+		return nil, p.errorf("missing value")
+	}
+	switch p.peek() {
+	case '"', '\'':
+		return p.str()
+	case '[':
+		p.pos++
+		arr := make([]interface{}, 0)
+		for {
+			p.skipSpace(true)
+			if p.eof() {
+				return nil, p.errorf("missing ']'")
+			}
+			if p.peek() == ']' {
+				p.pos++
+				return arr, nil
+			}
+			val, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, val)
+			p.skipSpace(true)
+			if !p.eof() && p.peek() == ',' {
+				p.pos++
+			} else if p.eof() || p.peek() != ']' {
+				return nil, p.errorf("expected ',' or ']' in array")
+			}
+		}
+	}
+	start := p.pos
+	for !p.eof() && !strings.ContainsRune(" \t\r\n,]#", rune(p.peek())) {
+		p.pos++
+	}
+	tok := p.s[start:p.pos]
+	switch tok {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	num := strings.Replace(tok, "_", "", -1)
+	if i, err := strconv.ParseInt(num, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(num, 64); err == nil {
+		return f, nil
+	}
+	return nil, p.errorf("invalid value '%s'", tok)
+}
@@ -1,12 +1,20 @@
 package util
 
 import (
+	"archive/zip"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 )
 
 var invalidCharsRegex = regexp.MustCompile(`[\\?%\*:;\|\"\'><\$!]`)
@@ -94,3 +102,126 @@ func ReadJSON(fn string, out interface{}) (emptyOrNotExist bool, err error) {
 	}
 	return false, err
 }
+
+// encryptedMagic identifies files written by WriteEncryptedJSON
+var encryptedMagic = []byte("KUENC1")
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// WriteEncryptedJSON is a helper function to write JSON to a file, encrypted
+// with AES-GCM. key must be 16, 24 or 32 bytes long
+func WriteEncryptedJSON(fn string, key []byte, v interface{}) error {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("WriteEncryptedJSON Marshal: %w", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return fmt.Errorf("WriteEncryptedJSON cipher: %w", err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("WriteEncryptedJSON nonce: %w", err)
+	}
+	var buf bytes.Buffer
+	buf.Write(encryptedMagic)
+	buf.Write(nonce)
+	buf.Write(gcm.Seal(nil, nonce, plain, encryptedMagic))
+	if err = ioutil.WriteFile(fn, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("WriteEncryptedJSON WriteFile: %w", err)
+	}
+	return nil
+}
+
+// ReadEncryptedJSON is a helper function to read JSON written by WriteEncryptedJSON
+func ReadEncryptedJSON(fn string, key []byte, out interface{}) (emptyOrNotExist bool, err error) {
+	data, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, fmt.Errorf("ReadEncryptedJSON ReadFile: %w", err)
+	} else if len(data) == 0 {
+		return true, nil
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return false, fmt.Errorf("ReadEncryptedJSON cipher: %w", err)
+	}
+	if len(data) < len(encryptedMagic)+gcm.NonceSize() || !bytes.HasPrefix(data, encryptedMagic) {
+		return false, fmt.Errorf("ReadEncryptedJSON: not an encrypted file")
+	}
+	data = data[len(encryptedMagic):]
+	nonce, sealed := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, sealed, encryptedMagic)
+	if err != nil {
+		return false, fmt.Errorf("ReadEncryptedJSON Open: %w", err)
+	}
+	if err = json.Unmarshal(plain, out); err != nil {
+		err = fmt.Errorf("ReadEncryptedJSON Decode: %w", err)
+	}
+	return false, err
+}
+
+// LogRing is an io.Writer that keeps the most recent lines written to it.
+// It is intended to be used as an additional output for the log package.
+type LogRing struct {
+	mux   sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+// NewLogRing creates a LogRing holding up to size lines
+func NewLogRing(size int) *LogRing {
+	return &LogRing{lines: make([]string, size)}
+}
+
+// Write stores each line in p, discarding the oldest lines if required
+func (lr *LogRing) Write(p []byte) (int, error) {
+	lr.mux.Lock()
+	defer lr.mux.Unlock()
+	if len(lr.lines) == 0 {
+		return len(p), nil
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		lr.lines[lr.next] = line
+		lr.next = (lr.next + 1) % len(lr.lines)
+		if lr.next == 0 {
+			lr.full = true
+		}
+	}
+	return len(p), nil
+}
+
+// Lines returns the stored lines, oldest first
+func (lr *LogRing) Lines() []string {
+	lr.mux.Lock()
+	defer lr.mux.Unlock()
+	if !lr.full {
+		return append([]string(nil), lr.lines[:lr.next]...)
+	}
+	return append(append([]string(nil), lr.lines[lr.next:]...), lr.lines[:lr.next]...)
+}
+
+// IsZipBook reports whether the book at bkPath is a format that should be a valid ZIP archive
+func IsZipBook(bkPath string) bool {
+	ext := strings.ToLower(filepath.Ext(bkPath))
+	// Note, kepubs on the Kobo always end in ".kepub.epub"
+	return ext == ".epub" || ext == ".cbz"
+}
+
+// CheckZip checks that the central directory of a ZIP archive can be read
+func CheckZip(fn string) error {
+	zr, err := zip.OpenReader(fn)
+	if err != nil {
+		return fmt.Errorf("CheckZip: %w", err)
+	}
+	zr.Close()
+	return nil
+}
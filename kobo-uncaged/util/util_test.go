@@ -1 +1,169 @@
 package util
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedJSONRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ku-util")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "enc.json")
+	key := make([]byte, 32)
+	in := map[string]string{"password": "hunter2"}
+	if err := WriteEncryptedJSON(fn, key, in); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "hunter2") {
+		t.Error("password stored in plain text")
+	}
+	out := map[string]string{}
+	if _, err := ReadEncryptedJSON(fn, key, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["password"] != "hunter2" {
+		t.Errorf("got %q, want %q", out["password"], "hunter2")
+	}
+	key[0] = 1
+	if _, err := ReadEncryptedJSON(fn, key, &out); err == nil {
+		t.Error("expected error decrypting with the wrong key")
+	}
+}
+
+func TestLogRing(t *testing.T) {
+	lr := NewLogRing(3)
+	lr.Write([]byte("one\n"))
+	lr.Write([]byte("two\n"))
+	if got, want := lr.Lines(), []string{"one", "two"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	lr.Write([]byte("three\nfour\n"))
+	if got, want := lr.Lines(), []string{"two", "three", "four"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCheckZip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ku-util")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	good := filepath.Join(dir, "good.kepub.epub")
+	f, err := os.Create(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	if _, err = zw.Create("mimetype"); err != nil {
+		t.Fatal(err)
+	}
+	zw.Close()
+	f.Close()
+	if !IsZipBook(good) {
+		t.Errorf("expected %s to be a zip book", good)
+	}
+	if err = CheckZip(good); err != nil {
+		t.Error(err)
+	}
+	bad := filepath.Join(dir, "bad.epub")
+	if err = ioutil.WriteFile(bad, []byte("not a zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckZip(bad); err == nil {
+		t.Error("expected error checking a file that is not a zip")
+	}
+}
+
+func TestSanitizeLpath(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	tests := []struct {
+		lpath, profile, want string
+	}{
+		{"Author/Title.epub", SanitizeFAT, "Author/Title.epub"},
+		{"Author: Name/Title?.kepub.epub", SanitizeFAT, "Author_ Name/Title_.kepub.epub"},
+		{"../../etc/./passwd", SanitizeFAT, "etc/passwd"},
+		{"Dir.  /Tab\there.epub", SanitizeFAT, "Dir_/Tab_here.epub"},
+		{"con/aux.pdf", SanitizeFAT, "con_/aux_.pdf"},
+		{"Bro\u0301nte\u0308.epub", SanitizeFAT, "Br\u00f3nt\u00eb.epub"},
+		{long + "/" + long + ".kepub.epub", SanitizeFAT, strings.Repeat("a", 86) + "/" + strings.Repeat("a", 87) + ".kepub.epub"},
+		{"Dir.  /Tab\there.epub", SanitizeLegacy, "Dir.  /Tab\there.epub"},
+	}
+	for _, tt := range tests {
+		got := SanitizeLpath(tt.lpath, tt.profile)
+		if got != tt.want {
+			t.Errorf("SanitizeLpath(%q, %q) = %q, want %q", tt.lpath, tt.profile, got, tt.want)
+		}
+		if again := SanitizeLpath(got, tt.profile); again != got {
+			t.Errorf("SanitizeLpath(%q, %q) is not stable: %q", got, tt.profile, again)
+		}
+		if tt.profile == SanitizeFAT && utf16Len(got) > MaxLpathLen {
+			t.Errorf("SanitizeLpath(%q) is too long: %d", tt.lpath, utf16Len(got))
+		}
+	}
+}
+
+func TestNormalizeSeries(t *testing.T) {
+	tests := []struct{ a, b string }{
+		{"The Expanse", "Expanse"},
+		{"Expanse, The", "the expanse series"},
+		{"Ender's Saga", "Enders"},
+		{"Lord of the Rings Trilogy", "The Lord of the Rings"},
+		{"Discworld: Watch", "discworld - watch"},
+		{"The", "the"},
+	}
+	for _, tc := range tests {
+		if a, b := NormalizeSeries(tc.a), NormalizeSeries(tc.b); a != b {
+			t.Errorf("NormalizeSeries(%q) = %q, NormalizeSeries(%q) = %q, want equal", tc.a, a, tc.b, b)
+		}
+	}
+	if NormalizeSeries("Discworld") == NormalizeSeries("Discworld: Watch") {
+		t.Errorf("different series normalized to the same name")
+	}
+}
+
+func TestParseTOML(t *testing.T) {
+	data := `# Kobo-UNCaGED config
+preferSDCard = false
+PreferKepub = true # trailing comment
+passwordList = [
+	"pa\"ss",
+	'c:\pass',
+]
+
+[thumbnail]
+generateLevel = "partial"
+jpegQuality = 1_00
+`
+	got, err := ParseTOML([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"preferSDCard":            false,
+		"PreferKepub":             true,
+		"passwordList":            []interface{}{`pa"ss`, `c:\pass`},
+		"thumbnail.generateLevel": "partial",
+		"thumbnail.jpegQuality":   int64(100),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseTOML() = %v, want %v", got, want)
+	}
+	for _, bad := range []string{"a = ", "a = \"b", "a = 1\na = 2", "a = [1, 2", "[t\na = 1", "a = yes", "a = 1 b"} {
+		if _, err := ParseTOML([]byte(bad)); err == nil {
+			t.Errorf("ParseTOML(%q) accepted invalid TOML", bad)
+		}
+	}
+}
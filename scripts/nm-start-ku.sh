@@ -8,6 +8,7 @@ KU_LOG=${KU_DIR}/ku_error.log
 
 KU_REPL_MD=${KU_DIR}/replace-book.sql
 KU_UPDATE_MD=${KU_DIR}/updated-md.sql
+KU_MIGRATE=${KU_DIR}/migrate.sql
 
 # Inport logmsg function
 . ${KU_DIR}/scripts/ku-lib.sh
@@ -23,6 +24,19 @@ EOF
     if [ $sqlite_res -ne 0 ] ; then 
         logmsg "E" "$sqlite_err" 5000
     fi
+    return $sqlite_res
+}
+
+# Books moved between internal storage and the SD card have already been moved, so
+# their ContentIDs must be updated, whatever happened to KU. The SQL is safe to apply
+# more than once, so it is kept for next time if it fails.
+apply_migration() {
+    if [ -f $KU_MIGRATE ] ; then
+        logmsg "I" "Updating library for moved books" 1000
+        call_sqlite "$KU_MIGRATE" && rm $KU_MIGRATE
+        return 0
+    fi
+    return 1
 }
 
 # In case we aren't launched with NickelMenu, check that NickelDBus is
@@ -35,6 +49,10 @@ fi
 # Ensure before beginning that any sql files from prior runs are removed
 [ -f $KU_REPL_MD ] && rm $KU_REPL_MD
 [ -f $KU_UPDATE_MD ] && rm $KU_UPDATE_MD
+# Except for moved books, which must not be forgotten
+if apply_migration ; then
+    qndb -s pfmDoneProcessing -m pfmRescanBooksFull
+fi
 
 # For some reason, kobo's don't enable the loopback network interface
 # We take care of it here
@@ -49,6 +67,8 @@ cd ${KU_DIR}
 logmsg "I" "Starting Kobo UNCaGED" 1000
 $KU_BIN
 KU_RES=$?
+KU_MIGRATED=0
+apply_migration && KU_MIGRATED=1
 if [ "$KU_RES" -eq 0 ] ; then
     if [ -f $KU_REPL_MD ] ; then
         logmsg "I" "Updating replacement book filesize(s)" 1000
@@ -68,7 +88,7 @@ if [ "$KU_RES" -eq 0 ] ; then
     fi
     [ -f $KU_REPL_MD ] && rm $KU_REPL_MD
     [ -f $KU_UPDATE_MD ] && rm $KU_UPDATE_MD
-elif [ "$KU_RES" -eq 250 ] ; then
+elif [ "$KU_RES" -eq 250 ] || [ "$KU_MIGRATED" -eq 1 ] ; then
     logmsg "I" "Running precautionary library rescan" 1000
     qndb -s pfmDoneProcessing -m pfmRescanBooksFull
 fi